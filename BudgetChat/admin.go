@@ -0,0 +1,322 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const AdminHelpMessage = `users                  list everyone in the room with their address
+kick <name> [reason]   disconnect a user
+ban <name|ip>          kick and keep out a name or an IP address
+unban <name|ip>        lift a ban
+bans                   list all bans
+announce <text>        tell everyone in the room something
+stats                  show what the room has been up to
+quit                   close the admin connection`
+
+// Names and IP addresses that may not join the room
+type BanList struct {
+	mu    sync.Mutex
+	names map[string]bool
+	ips   map[string]bool
+}
+
+func NewBanList() *BanList {
+	return &BanList{names: make(map[string]bool), ips: make(map[string]bool)}
+}
+
+// Bans target, which is an IP address if it parses as one and a name
+// otherwise. Names are compared case-insensitively.
+func (b *BanList) Ban(target string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if ip := net.ParseIP(target); ip != nil {
+		b.ips[ip.String()] = true
+	} else {
+		b.names[strings.ToLower(target)] = true
+	}
+}
+
+// Returns false if target wasn't banned
+func (b *BanList) Unban(target string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	bans, key := b.names, strings.ToLower(target)
+	if ip := net.ParseIP(target); ip != nil {
+		bans, key = b.ips, ip.String()
+	}
+	if !bans[key] {
+		return false
+	}
+	delete(bans, key)
+	return true
+}
+
+func (b *BanList) NameBanned(name string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.names[strings.ToLower(name)]
+}
+
+// Whether the IP of addr is banned, false for a nil addr
+func (b *BanList) AddrBanned(addr net.Addr) bool {
+	if addr == nil {
+		return false
+	}
+	ip := net.ParseIP(remoteIP(addr))
+	if ip == nil {
+		return false
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.ips[ip.String()]
+}
+
+// Every banned name and IP, sorted
+func (b *BanList) List() []string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var bans []string
+	for name := range b.names {
+		bans = append(bans, name)
+	}
+	for ip := range b.ips {
+		bans = append(bans, ip)
+	}
+	sort.Strings(bans)
+	return bans
+}
+
+// What the admin console shows about a user
+type UserInfo struct {
+	Name string
+	// Empty for users without a connection
+	Addr string
+	// Messages their outbox threw away because they were too slow
+	Dropped int
+}
+
+type RoomStats struct {
+	Users       int
+	Connections int
+	Joins       int
+	Messages    int
+	Kicks       int
+	Dropped     int
+	Started     time.Time
+}
+
+func (cr *ChatRoom) Users() []UserInfo {
+	var users []UserInfo
+	cr.do(func() {
+		for _, user := range cr.users {
+			info := UserInfo{Name: user.Name(), Dropped: user.outbox.Dropped()}
+			if user.addr != nil {
+				info.Addr = user.addr.String()
+			}
+			users = append(users, info)
+		}
+	})
+	return users
+}
+
+func (cr *ChatRoom) Stats() RoomStats {
+	var stats RoomStats
+	cr.do(func() {
+		stats = cr.stats
+		stats.Users = len(cr.users)
+		for _, user := range cr.users {
+			stats.Dropped += user.outbox.Dropped()
+		}
+	})
+	stats.Connections = cr.connections.Open()
+	return stats
+}
+
+// Disconnects the user called name, telling them why
+func (cr *ChatRoom) Kick(name string, reason string) error {
+	if reason == "" {
+		reason = "no reason given"
+	}
+	var err error
+	cr.do(func() {
+		user := cr.findUser(name)
+		if user == nil {
+			err = fmt.Errorf("no user named %s", name)
+			return
+		}
+		cr.kickUser(user, fmt.Sprintf(KickedByAdminMessage, reason))
+	})
+	return err
+}
+
+// Bans a name or an IP address and kicks everyone it applies to. Returns
+// how many users got kicked.
+func (cr *ChatRoom) Ban(target string) int {
+	cr.bans.Ban(target)
+	kicked := 0
+	cr.do(func() {
+		for _, user := range cr.users {
+			if cr.bans.NameBanned(user.Name()) || cr.bans.AddrBanned(user.addr) {
+				cr.kickUser(user, BannedMessage)
+				kicked++
+			}
+		}
+	})
+	return kicked
+}
+
+// Sends text to everyone in the room
+func (cr *ChatRoom) Announce(text string) {
+	announcement := notice(fmt.Sprintf(AnnouncementMessage, text))
+	cr.do(func() {
+		cr.transcript.Record(announcement)
+		cr.broadcast(announcement, nil)
+	})
+}
+
+// Runs on the room goroutine. The user leaves the room the usual way once
+// their connection is closed.
+func (cr *ChatRoom) kickUser(user *User, reason string) {
+	log.Printf("Kicking %s: %s", user.Name(), strings.TrimSpace(reason))
+	user.outbox.Kick(notice(reason))
+	cr.stats.Kicks++
+}
+
+// Executes one line of the admin command language and returns its output
+func (cr *ChatRoom) RunAdminCommand(line string) ([]string, error) {
+	name, rest, _ := strings.Cut(strings.TrimSpace(line), " ")
+	rest = strings.TrimSpace(rest)
+
+	switch name {
+	case "users":
+		var lines []string
+		for _, user := range cr.Users() {
+			addr := user.Addr
+			if addr == "" {
+				addr = "-"
+			}
+			lines = append(lines, fmt.Sprintf("%s %s dropped=%d", user.Name, addr, user.Dropped))
+		}
+		return lines, nil
+	case "kick":
+		target, reason, _ := strings.Cut(rest, " ")
+		if target == "" {
+			return nil, errors.New("usage: kick <name> [reason]")
+		}
+		return nil, cr.Kick(target, strings.TrimSpace(reason))
+	case "ban":
+		if rest == "" || strings.Contains(rest, " ") {
+			return nil, errors.New("usage: ban <name|ip>")
+		}
+		kicked := cr.Ban(rest)
+		return []string{fmt.Sprintf("banned %s, kicked %d users", rest, kicked)}, nil
+	case "unban":
+		if rest == "" {
+			return nil, errors.New("usage: unban <name|ip>")
+		}
+		if !cr.bans.Unban(rest) {
+			return nil, fmt.Errorf("%s is not banned", rest)
+		}
+		return nil, nil
+	case "bans":
+		return cr.bans.List(), nil
+	case "announce":
+		if rest == "" {
+			return nil, errors.New("usage: announce <text>")
+		}
+		cr.Announce(rest)
+		return nil, nil
+	case "stats":
+		stats := cr.Stats()
+		return []string{
+			fmt.Sprintf("users %d", stats.Users),
+			fmt.Sprintf("connections %d", stats.Connections),
+			fmt.Sprintf("joins %d", stats.Joins),
+			fmt.Sprintf("messages %d", stats.Messages),
+			fmt.Sprintf("kicks %d", stats.Kicks),
+			fmt.Sprintf("dropped %d", stats.Dropped),
+			fmt.Sprintf("uptime %s", time.Since(stats.Started).Round(time.Second)),
+		}, nil
+	case "help":
+		return strings.Split(AdminHelpMessage, "\n"), nil
+	case "":
+		return nil, nil
+	}
+	return nil, fmt.Errorf("unknown command %s, try help", name)
+}
+
+// Listens for admin connections on addr, either "unix:/path/to/socket" or a
+// loopback TCP address. Anyone who can connect controls the room, so it
+// refuses to listen anywhere else.
+func ListenAdmin(addr string) (net.Listener, error) {
+	if path := strings.TrimPrefix(addr, "unix:"); path != addr {
+		// A socket left over from a previous run that didn't shut down
+		// cleanly, anything else is probably a typo and stays
+		if info, err := os.Lstat(path); err == nil {
+			if info.Mode()&os.ModeSocket == 0 {
+				return nil, fmt.Errorf("%s exists and isn't a socket", path)
+			}
+			if err := os.Remove(path); err != nil {
+				return nil, err
+			}
+		}
+		return listenPrivateUnix(path)
+	}
+
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	if ip := net.ParseIP(host); host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+		return nil, errors.New("admin console only listens on loopback addresses or unix sockets")
+	}
+	return net.Listen("tcp", addr)
+}
+
+// Speaks the admin command language: one command per line, answered with
+// its output and a final "OK" or "ERR <why>" line
+func handleAdminConnection(conn net.Conn, chatRoom *ChatRoom) {
+	defer conn.Close()
+	fmt.Fprint(conn, "BudgetChat admin console, try help\n")
+
+	scanner := bufio.NewScanner(conn)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.TrimSpace(line) == "quit" {
+			return
+		}
+		log.Println("Admin: ", line)
+
+		output, err := chatRoom.RunAdminCommand(line)
+		for _, outputLine := range output {
+			fmt.Fprintf(conn, "%s\n", outputLine)
+		}
+		if err != nil {
+			fmt.Fprintf(conn, "ERR %s\n", err)
+		} else {
+			fmt.Fprint(conn, "OK\n")
+		}
+	}
+}
+
+// Accepts admin connections until the listener fails
+func ServeAdmin(listen net.Listener, chatRoom *ChatRoom) error {
+	for {
+		conn, err := listen.Accept()
+		if err != nil {
+			return err
+		}
+		log.Println("Got Admin Connection")
+
+		go handleAdminConnection(conn, chatRoom)
+	}
+}
@@ -0,0 +1,21 @@
+//go:build windows || plan9
+
+package main
+
+import (
+	"net"
+	"os"
+)
+
+// No umask here, so this is the best we can do
+func listenPrivateUnix(path string) (net.Listener, error) {
+	listen, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, 0600); err != nil {
+		listen.Close()
+		return nil, err
+	}
+	return listen, nil
+}
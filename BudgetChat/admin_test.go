@@ -0,0 +1,198 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+type testAdmin struct {
+	t      *testing.T
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+func dialTestAdmin(t *testing.T, network string, addr string) *testAdmin {
+	conn, err := net.Dial(network, addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	t.Cleanup(func() { conn.Close() })
+	admin := &testAdmin{t: t, conn: conn, reader: bufio.NewReader(conn)}
+	expectLine(t, admin.reader, "BudgetChat admin console, try help\n")
+	return admin
+}
+
+// Runs command and returns its output, the final OK/ERR line included
+func (a *testAdmin) run(command string) []string {
+	a.t.Helper()
+	fmt.Fprintf(a.conn, "%s\n", command)
+	var lines []string
+	for {
+		line, err := a.reader.ReadString('\n')
+		if err != nil {
+			a.t.Fatalf("%s: %v", command, err)
+		}
+		line = strings.TrimSuffix(line, "\n")
+		lines = append(lines, line)
+		if line == "OK" || strings.HasPrefix(line, "ERR ") {
+			return lines
+		}
+	}
+}
+
+func startTestAdmin(t *testing.T, chatRoom *ChatRoom) string {
+	listen, err := ListenAdmin("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listen.Close() })
+	go ServeAdmin(listen, chatRoom)
+	return listen.Addr().String()
+}
+
+func TestAdminConsole(t *testing.T) {
+	addr, chatRoom := startTestServer(t, DefaultRoomConfig())
+	admin := dialTestAdmin(t, "tcp", startTestAdmin(t, chatRoom))
+
+	alice, aliceReader, _ := joinTestClient(t, addr, "alice")
+	defer alice.Close()
+	bob, bobReader, _ := joinTestClient(t, addr, "bob")
+	defer bob.Close()
+	expectLine(t, aliceReader, "* bob joined this chat room\n")
+
+	users := admin.run("users")
+	if len(users) != 3 || !strings.HasPrefix(users[0], "alice 127.0.0.1:") || !strings.HasPrefix(users[1], "bob 127.0.0.1:") {
+		t.Errorf("unexpected user list: %q", users)
+	}
+
+	admin.run("announce maintenance at noon")
+	expectLine(t, aliceReader, "* Announcement: maintenance at noon\n")
+	expectLine(t, bobReader, "* Announcement: maintenance at noon\n")
+
+	if response := admin.run("kick carol"); response[0] != "ERR no user named carol" {
+		t.Errorf("unexpected response: %q", response)
+	}
+	admin.run("kick bob spamming")
+	expectLine(t, bobReader, "* Kicked by an admin: spamming\n")
+	if line, err := bobReader.ReadString('\n'); err == nil {
+		t.Errorf("bob should be disconnected, got %q", line)
+	}
+	expectLine(t, aliceReader, "* bob left the chat room\n")
+
+	// Banned names stay out, also when renaming
+	admin.run("ban Bob")
+	_, _, response := joinTestClient(t, addr, "bob")
+	if response != "* Name rejected: username is banned\n" {
+		t.Errorf("unexpected response: %q", response)
+	}
+	fmt.Fprint(alice, "/nick BOB\n")
+	expectLine(t, aliceReader, "* Error: username is banned\n")
+
+	stats := admin.run("stats")
+	for _, expected := range []string{"users 1", "joins 2", "kicks 1"} {
+		found := false
+		for _, line := range stats {
+			found = found || line == expected
+		}
+		if !found {
+			t.Errorf("expected %q in stats %q", expected, stats)
+		}
+	}
+
+	// Banning an IP kicks everyone connecting from it
+	if response := admin.run("ban 127.0.0.1"); response[0] != "banned 127.0.0.1, kicked 1 users" {
+		t.Errorf("unexpected response: %q", response)
+	}
+	expectLine(t, aliceReader, "* You are banned\n")
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	expectLine(t, bufio.NewReader(conn), "* You are banned\n")
+	conn.Close()
+
+	if response := admin.run("bans"); strings.Join(response, ",") != "127.0.0.1,bob,OK" {
+		t.Errorf("unexpected bans: %q", response)
+	}
+	admin.run("unban 127.0.0.1")
+	carol, _, userList := joinTestClient(t, addr, "carol")
+	defer carol.Close()
+	if !strings.HasPrefix(userList, "* Users in Room") {
+		t.Errorf("carol should be let in again, got %q", userList)
+	}
+
+	if response := admin.run("unban 127.0.0.1"); response[0] != "ERR 127.0.0.1 is not banned" {
+		t.Errorf("unexpected response: %q", response)
+	}
+	if response := admin.run("shutdown"); response[0] != "ERR unknown command shutdown, try help" {
+		t.Errorf("unexpected response: %q", response)
+	}
+}
+
+func TestAdminOnlyListensLocally(t *testing.T) {
+	for _, addr := range []string{":0", "0.0.0.0:0", "192.0.2.1:0"} {
+		if listen, err := ListenAdmin(addr); err == nil {
+			listen.Close()
+			t.Errorf("Admin console should refuse to listen on %s", addr)
+		}
+	}
+
+	_, chatRoom := startTestServer(t, DefaultRoomConfig())
+	path := filepath.Join(t.TempDir(), "admin.sock")
+	listen, err := ListenAdmin("unix:" + path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listen.Close()
+	go ServeAdmin(listen, chatRoom)
+
+	admin := dialTestAdmin(t, "unix", path)
+	if response := admin.run("users"); len(response) != 1 || response[0] != "OK" {
+		t.Errorf("unexpected response: %q", response)
+	}
+}
+
+func TestAdminSocket(t *testing.T) {
+	dir := t.TempDir()
+
+	// A mistyped path must not cost anyone their file
+	file := filepath.Join(dir, "notes.txt")
+	os.WriteFile(file, []byte("important"), 0644)
+	if listen, err := ListenAdmin("unix:" + file); err == nil {
+		listen.Close()
+		t.Error("Admin console should refuse to replace a regular file")
+	}
+	if content, _ := os.ReadFile(file); string(content) != "important" {
+		t.Errorf("file got changed: %q", content)
+	}
+
+	// Left behind by a crash
+	path := filepath.Join(dir, "admin.sock")
+	stale, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+
+	listen, err := ListenAdmin("unix:" + path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listen.Close()
+	info, err := os.Lstat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if perm := info.Mode().Perm(); perm != 0600 {
+		t.Errorf("expected the socket to be 0600, got %o", perm)
+	}
+}
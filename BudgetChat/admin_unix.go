@@ -0,0 +1,22 @@
+//go:build !windows && !plan9
+
+package main
+
+import (
+	"net"
+	"sync"
+	"syscall"
+)
+
+// Umask is per process, so two of these mustn't overlap
+var umaskMu sync.Mutex
+
+// Creates the socket as 0600 right away, so nobody else can connect in
+// between creating and chmodding it
+func listenPrivateUnix(path string) (net.Listener, error) {
+	umaskMu.Lock()
+	defer umaskMu.Unlock()
+	old := syscall.Umask(0177)
+	defer syscall.Umask(old)
+	return net.Listen("unix", path)
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Passwords of registered users, read from an htpasswd style file with one
+// "name:hash" per line. Hashes are bcrypt (htpasswd -B, or -hash-password).
+// Old {SHA} (htpasswd -s) and {SSHA} (slappasswd) hashes can still be read
+// but are too fast to guess for new passwords. Names are looked up
+// case-insensitively so nobody can sneak around a password by changing case.
+type PasswordFile struct {
+	hashes map[string]string
+}
+
+func LoadPasswordFile(path string) (*PasswordFile, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	passwords := &PasswordFile{hashes: make(map[string]string)}
+	scanner := bufio.NewScanner(file)
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		name, hash, found := strings.Cut(line, ":")
+		if !found || name == "" {
+			return nil, fmt.Errorf("%s:%d: expected name:hash", path, lineNumber)
+		}
+		if err := checkHash(hash); err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", path, lineNumber, err)
+		}
+		passwords.hashes[strings.ToLower(name)] = hash
+	}
+	return passwords, scanner.Err()
+}
+
+// Hashes we can't check would lock their user out for good, so they are
+// refused when loading instead
+func checkHash(hash string) error {
+	var scheme string
+	switch {
+	case strings.HasPrefix(hash, "{SHA}"):
+		raw, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(hash, "{SHA}"))
+		if err != nil || len(raw) != sha1.Size {
+			return errors.New("broken {SHA} hash")
+		}
+		return nil
+	case strings.HasPrefix(hash, "{SSHA}"):
+		raw, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(hash, "{SSHA}"))
+		if err != nil || len(raw) <= sha1.Size {
+			return errors.New("broken {SSHA} hash")
+		}
+		return nil
+	case isBcrypt(hash):
+		if _, err := bcrypt.Cost([]byte(hash)); err != nil {
+			return fmt.Errorf("broken bcrypt hash: %w", err)
+		}
+		return nil
+	case strings.HasPrefix(hash, "$apr1$"):
+		scheme = "MD5 ($apr1$)"
+	case strings.HasPrefix(hash, "$"):
+		scheme = "crypt " + strings.SplitN(hash, "$", 3)[1]
+	default:
+		scheme = "plain text or crypt"
+	}
+	return fmt.Errorf("%s hashes are not supported, use bcrypt (htpasswd -B)", scheme)
+}
+
+func isBcrypt(hash string) bool {
+	return strings.HasPrefix(hash, "$2a$") || strings.HasPrefix(hash, "$2b$") || strings.HasPrefix(hash, "$2y$")
+}
+
+// Whether name is registered, false for a nil PasswordFile
+func (p *PasswordFile) Has(name string) bool {
+	if p == nil {
+		return false
+	}
+	_, found := p.hashes[strings.ToLower(name)]
+	return found
+}
+
+func (p *PasswordFile) Verify(name string, password string) bool {
+	if p == nil {
+		return false
+	}
+	hash, found := p.hashes[strings.ToLower(name)]
+	if !found {
+		return false
+	}
+	if isBcrypt(hash) {
+		return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+	}
+
+	var salt []byte
+	if strings.HasPrefix(hash, "{SSHA}") {
+		raw, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(hash, "{SSHA}"))
+		if err != nil || len(raw) <= sha1.Size {
+			return false
+		}
+		salt = raw[sha1.Size:]
+	}
+	expected := shaHash(password, salt)
+	return subtle.ConstantTimeCompare([]byte(expected), []byte(hash)) == 1
+}
+
+// Legacy {SSHA} hash if a salt is given and {SHA} otherwise, only used to
+// check old entries
+func shaHash(password string, salt []byte) string {
+	hash := sha1.New()
+	hash.Write([]byte(password))
+	hash.Write(salt)
+	if len(salt) == 0 {
+		return "{SHA}" + base64.StdEncoding.EncodeToString(hash.Sum(nil))
+	}
+	return "{SSHA}" + base64.StdEncoding.EncodeToString(append(hash.Sum(nil), salt...))
+}
+
+// Hashes password for a PasswordFile with bcrypt
+func NewPasswordHash(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	return string(hash), err
+}
+
+// Asks for the password if name is registered. Returns an error if the
+// user may not use name.
+func (cr *ChatRoom) Authenticate(conn net.Conn, name string) error {
+	if !cr.config.Passwords.Has(name) {
+		return cr.CheckPassword(name, "")
+	}
+
+	fmt.Fprintf(conn, PasswordPrompt, name)
+	var password []byte
+	if err := ReadMessage(conn, &password); err != nil {
+		return err
+	}
+	return cr.CheckPassword(name, strings.TrimRight(string(password), "\r\n"))
+}
+
+// Checks a password given some other way, e.g. IRC's PASS
+func (cr *ChatRoom) CheckPassword(name string, password string) error {
+	passwords := cr.config.Passwords
+	if !passwords.Has(name) {
+		if cr.config.RequireAuth {
+			return errors.New("unknown user")
+		}
+		return nil
+	}
+	if !passwords.Verify(name, password) {
+		return errors.New("wrong password")
+	}
+	return nil
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestHashPassword(t *testing.T) {
+	// Same as `htpasswd -nbs alice password`
+	if hash := shaHash("password", nil); hash != "{SHA}W6ph5Mm5Pz8GgiULbPgzG37mj9g=" {
+		t.Errorf("unexpected {SHA} hash: %q", hash)
+	}
+
+	hashed, err := NewPasswordHash("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !isBcrypt(hashed) || checkHash(hashed) != nil {
+		t.Errorf("expected a bcrypt hash, got %q", hashed)
+	}
+	other, _ := NewPasswordHash("secret")
+	if hashed == other {
+		t.Error("Two hashes of the same password should differ")
+	}
+
+	// htpasswd -B writes $2y$, which is the same algorithm
+	htpasswd := "$2y$" + strings.TrimPrefix(hashed, "$2a$")
+	passwords := &PasswordFile{hashes: map[string]string{
+		"alice": hashed,
+		"bob":   shaHash("password", nil),
+		"carol": shaHash("hunter2", []byte("salt")),
+		"dave":  htpasswd,
+	}}
+	type test struct {
+		Name     string
+		Password string
+		Expected bool
+	}
+	testCases := []test{
+		{Name: "alice", Password: "secret", Expected: true},
+		{Name: "ALICE", Password: "secret", Expected: true},
+		{Name: "alice", Password: "Secret", Expected: false},
+		{Name: "bob", Password: "password", Expected: true},
+		{Name: "bob", Password: "", Expected: false},
+		{Name: "carol", Password: "hunter2", Expected: true},
+		{Name: "carol", Password: "hunter3", Expected: false},
+		{Name: "dave", Password: "secret", Expected: true},
+		{Name: "dave", Password: "", Expected: false},
+		{Name: "erin", Password: "", Expected: false},
+	}
+	for _, tc := range testCases {
+		if got := passwords.Verify(tc.Name, tc.Password); got != tc.Expected {
+			t.Errorf("Name: %q, Password: %q, expected: %v, got: %v", tc.Name, tc.Password, tc.Expected, got)
+		}
+	}
+
+	var none *PasswordFile
+	if none.Has("alice") || none.Verify("alice", "") {
+		t.Error("A nil PasswordFile should know nobody")
+	}
+}
+
+func TestLoadPasswordFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "passwd")
+	content := "# registered users\nAlice:{SHA}W6ph5Mm5Pz8GgiULbPgzG37mj9g=\n\nBob:" + mustHash("letmein") + "\n"
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	passwords, err := LoadPasswordFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !passwords.Verify("alice", "password") || !passwords.Verify("bob", "letmein") {
+		t.Error("alice and bob should be able to log in")
+	}
+
+	// Hashes we can't check must be refused right away, not when alice
+	// tries to log in
+	type test struct {
+		Hash     string
+		Expected string
+	}
+	testCases := []test{
+		{Hash: "$2b$10$abcdefghijklmnopqrstuu", Expected: "broken bcrypt hash"},
+		{Hash: "$apr1$abc$def", Expected: "MD5 ($apr1$) hashes are not supported, use bcrypt (htpasswd -B)"},
+		{Hash: "$6$salt$hash", Expected: "crypt 6 hashes are not supported"},
+		{Hash: "rqXexS6ZhobKA", Expected: "plain text or crypt hashes are not supported"},
+		{Hash: "{SHA}not base64!", Expected: "broken {SHA} hash"},
+		{Hash: "{SHA}c2hvcnQ=", Expected: "broken {SHA} hash"},
+		{Hash: "{SSHA}W6ph5Mm5Pz8GgiULbPgzG37mj9g=", Expected: "broken {SSHA} hash"},
+	}
+	for _, tc := range testCases {
+		os.WriteFile(path, []byte("alice:"+tc.Hash+"\n"), 0600)
+		_, err := LoadPasswordFile(path)
+		if err == nil || !strings.Contains(err.Error(), tc.Expected) {
+			t.Errorf("Hash: %q, expected: %q, got: %v", tc.Hash, tc.Expected, err)
+		}
+	}
+}
+
+func mustHash(password string) string {
+	hash, err := NewPasswordHash(password)
+	if err != nil {
+		panic(err)
+	}
+	return hash
+}
+
+func testPasswordConfig() RoomConfig {
+	config := DefaultRoomConfig()
+	config.Passwords = &PasswordFile{hashes: map[string]string{"alice": mustHash("secret")}}
+	return config
+}
+
+func TestPasswordPrompt(t *testing.T) {
+	addr, _ := startTestServer(t, testPasswordConfig())
+
+	wrong, _, prompt := joinTestClient(t, addr, "alice")
+	defer wrong.Close()
+	if prompt != "* Password for alice?\n" {
+		t.Fatalf("expected password prompt, got %q", prompt)
+	}
+	fmt.Fprint(wrong, "guess\n")
+	_, _, response := joinTestClient(t, addr, "bob")
+	if response != "* Users in Room: \n" {
+		t.Errorf("alice should not have joined, got %q", response)
+	}
+
+	alice, aliceReader, _ := joinTestClient(t, addr, "alice")
+	defer alice.Close()
+	fmt.Fprint(alice, "secret\n")
+	expectLine(t, aliceReader, "* Users in Room: bob\n")
+
+	// Nobody can take a registered name by renaming either
+	carol, carolReader, _ := joinTestClient(t, addr, "carol")
+	defer carol.Close()
+	fmt.Fprint(carol, "/nick Alice\n")
+	expectLine(t, carolReader, "* Error: username is registered, reconnect to log in\n")
+}
+
+func TestRequireAuth(t *testing.T) {
+	config := testPasswordConfig()
+	config.RequireAuth = true
+	addr, _ := startTestServer(t, config)
+
+	conn, _, response := joinTestClient(t, addr, "bob")
+	defer conn.Close()
+	if response != "* Authentication failed: unknown user\n" {
+		t.Errorf("unexpected response: %q", response)
+	}
+}
+
+func TestIRCPassword(t *testing.T) {
+	_, chatRoom := startTestServer(t, testPasswordConfig())
+	ircAddr := startTestIRCServer(t, chatRoom)
+
+	wrong := dialTestIRC(t, ircAddr)
+	wrong.send("NICK alice")
+	wrong.send("USER alice 0 * :alice")
+	wrong.expect(
+		":budgetchat 464 alice :Password incorrect",
+		"ERROR :Closing Link (wrong password)",
+	)
+
+	alice := dialTestIRC(t, ircAddr)
+	alice.send("PASS secret")
+	alice.register("alice")
+}
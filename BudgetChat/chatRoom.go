@@ -1,179 +1,478 @@
 package main
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"log"
 	"net"
 	"strings"
+	"sync"
+	"time"
 
 	"golang.org/x/exp/slices"
 )
 
 type ChatRoom struct {
+	config      RoomConfig
 	amountUsers int32
 	users       []*User
+	history     *History
+	transcript  *Transcript
 	sendMessage chan Message
+	join        chan joinRequest
+	leave       chan leaveRequest
+	ops         chan func()
+	connections *ConnectionLimiter
+	bans        *BanList
+	// Counters kept by the room goroutine, Stats fills in the rest
+	stats RoomStats
+}
+
+type joinRequest struct {
+	user   *User
+	result chan error
+}
+
+type leaveRequest struct {
+	user *User
+	done chan struct{}
+}
+
+// Settings shared by every user of a room
+type RoomConfig struct {
+	// How many messages may wait for a user before OverflowPolicy kicks in
+	QueueSize      int
+	OverflowPolicy OverflowPolicy
+	// How many messages get replayed to someone joining, 0 disables history
+	HistorySize int
+
+	// Applied to every name on top of ValidateUsername, nil allows everything
+	UsernamePolicy UsernamePolicy
+	// Names only differing in case count as the same name
+	CaseInsensitiveNames bool
+	// Users in here have to give their password to use their name
+	Passwords *PasswordFile
+	// Nobody without an entry in Passwords gets in
+	RequireAuth bool
+
+	// Messages per second a user may send on average, 0 disables the limit
+	MessageRate float64
+	// Messages a user may send at once before MessageRate applies
+	MessageBurst int
+	// Messages dropped for flooding before the user gets muted, 0 never mutes
+	FloodStrikes int
+	MuteDuration time.Duration
+	// Mutes before the user gets kicked, 0 never kicks
+	KickAfterMutes int
+	// Connections one IP may have open at once, 0 is unlimited
+	MaxConnectionsPerIP int
+}
+
+func DefaultRoomConfig() RoomConfig {
+	return RoomConfig{
+		QueueSize:      DefaultQueueSize,
+		OverflowPolicy: DropOldest,
+		HistorySize:    DefaultHistorySize,
+		UsernamePolicy: PolicyChain{NormalizeUnicode()},
+
+		MessageRate:         DefaultMessageRate,
+		MessageBurst:        DefaultMessageBurst,
+		FloodStrikes:        DefaultFloodStrikes,
+		MuteDuration:        DefaultMuteDuration,
+		KickAfterMutes:      DefaultKickAfterMutes,
+		MaxConnectionsPerIP: DefaultMaxConnectionsPerIP,
+	}
+}
+
+func NewChatRoom(config RoomConfig) *ChatRoom {
+	return &ChatRoom{
+		config:      config,
+		amountUsers: 0,
+		history:     NewHistory(config.HistorySize),
+		sendMessage: make(chan Message),
+		join:        make(chan joinRequest),
+		leave:       make(chan leaveRequest),
+		ops:         make(chan func()),
+		connections: NewConnectionLimiter(config.MaxConnectionsPerIP),
+		bans:        NewBanList(),
+		stats:       RoomStats{Started: time.Now()},
+	}
 }
 
 type User struct {
+	// Only changes through /nick, use Name() to read it
+	mu       sync.Mutex
 	name     []byte
-	receiver chan string
-	sender   chan string
+	outbox   *Outbox
 	chatRoom *ChatRoom
-	exit     chan bool
+	flood    floodGuard
+	// Where the user connects from, nil if not connected over the network
+	addr net.Addr
+	// Turns messages into what goes over the wire, nil means Message.String
+	format func(Message) string
 }
 
-func (u *User) String() string {
+func NewUser(name string, chatRoom *ChatRoom) *User {
+	return &User{
+		name:     []byte(name),
+		outbox:   NewOutbox(chatRoom.config.QueueSize, chatRoom.config.OverflowPolicy),
+		chatRoom: chatRoom,
+		flood: floodGuard{
+			bucket: NewTokenBucket(chatRoom.config.MessageRate, chatRoom.config.MessageBurst),
+		},
+	}
+}
+
+func (u *User) Name() string {
+	u.mu.Lock()
+	defer u.mu.Unlock()
 	return string(u.name)
 }
 
+func (u *User) setName(name string) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.name = []byte(name)
+}
+
+func (u *User) String() string {
+	return u.Name()
+}
+
+func (u *User) render(msg Message) string {
+	if u.format != nil {
+		return u.format(msg)
+	}
+	return msg.String()
+}
+
+type MessageKind int
+
+const (
+	ChatMessage MessageKind = iota
+	JoinMessage
+	LeaveMessage
+	// Already formatted text from the server, e.g. an error
+	SystemMessage
+	// Everyone in the room, message is the comma separated list of names
+	UserListMessage
+	// Only goes to one user, sent with /msg
+	PrivateMessage
+	// Sent with /me
+	ActionMessage
+	// Someone changed their name with /nick, message is the new name
+	NickMessage
+)
+
 type Message struct {
+	kind MessageKind
+	// Set for messages coming from a connection, senderName is taken
+	// from it by the room in case the user renamed in the meantime
+	sender     *User
 	senderName string
 	message    string
 }
 
-// Continously checks if connection is dead
-func (user *User) CheckConnectionDead(conn net.Conn) {
-	zero := make([]byte, 0)
-	for {
-		select {
-		case <-user.exit:
-			user.exit <- true
-			return
-		default:
-			_, err := conn.Read(zero)
-			if err != nil {
-				user.exit <- true
-				return
-			}
-		}
-
+// Formats the message the way it goes over the wire
+func (m Message) String() string {
+	switch m.kind {
+	case JoinMessage:
+		return fmt.Sprintf(UserJoinedMessage, m.senderName)
+	case LeaveMessage:
+		return fmt.Sprintf(UserLeavesMessage, m.senderName)
+	case SystemMessage:
+		return m.message
+	case UserListMessage:
+		return fmt.Sprintf(UserListFormat, m.message)
+	case PrivateMessage:
+		return fmt.Sprintf(PrivateMessageFormat, m.senderName, m.message)
+	case ActionMessage:
+		return fmt.Sprintf(ActionMessageFormat, m.senderName, m.message)
+	case NickMessage:
+		return fmt.Sprintf(NickChangedMessage, m.senderName, m.message)
 	}
+	return fmt.Sprintf("[%s] %s", m.senderName, m.message)
 }
 
-// Puts everything received from the connection into the receiver chan
-func (user *User) StartReceiveHandler(conn net.Conn) {
-
+// Puts everything received from the connection into the chat room.
+// Returns once the connection fails or the client says goodbye.
+func (user *User) StartReceiveHandler(ctx context.Context, conn net.Conn) {
 	var msg []byte
 	for {
-		select {
-		case <-user.exit:
-			user.exit <- true
-			log.Println("Actually exiting user: ", string(user.name))
+		err := ReadMessage(conn, &msg)
+		if err != nil {
+			log.Println("Actually exiting user: ", user.Name())
 			return
+		}
 
-		default:
-			err := ReadMessage(conn, &msg)
-			if err != nil {
-				user.exit <- true
-				log.Println("Actually exiting user: ", string(user.name))
-				return
-			}
+		if string(msg) == "exit\n" {
+			log.Println("Trigger exit!")
+			return
+		}
 
-			log.Print("Message: ", string(msg))
-			if string(msg) == "exit\n" {
-				log.Println("Trigger exit!")
-				user.exit <- true
-				return
-			}
+		if !user.allowMessage() {
+			msg = nil
+			continue
+		}
 
-			user.chatRoom.sendMessage <- Message{
-				senderName: string(user.name),
-				message:    string(msg),
-			}
+		if IsCommand(string(msg)) {
+			user.chatRoom.RunCommand(user, string(msg))
 			msg = nil
+			continue
 		}
-	}
 
+		select {
+		case user.chatRoom.sendMessage <- Message{
+			sender:     user,
+			senderName: user.Name(),
+			message:    string(msg),
+		}:
+		case <-ctx.Done():
+			return
+		}
+		msg = nil
+	}
 }
 
-// Writes everything from "sender" chan to the client
-func (user *User) StartSendHandler(conn net.Conn) {
+// Writes everything from the outbox to the client until ctx is cancelled,
+// the outbox gives up on us or the connection fails
+func (user *User) StartSendHandler(ctx context.Context, conn net.Conn) {
+	// A write can block forever on a client that stopped reading. Once the
+	// outbox gives up on it, the deadline gets the write unstuck.
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-user.outbox.Closed():
+			conn.SetWriteDeadline(time.Now().Add(LastWordsTimeout))
+		case <-ctx.Done():
+		case <-stop:
+		}
+	}()
+
 	for {
 		select {
-		case <-user.exit:
-			log.Println("Actually exiting user: ", string(user.name))
-			user.exit <- true
+		case <-ctx.Done():
+			return
+		case <-user.outbox.Closed():
+			// Last words, e.g. why the user got kicked. The deadline keeps
+			// a stalled client from holding us up.
+			conn.SetWriteDeadline(time.Now().Add(LastWordsTimeout))
+			for _, msg := range user.outbox.Drain() {
+				conn.Write([]byte(user.render(msg)))
+			}
+			log.Println("Outbox closed, exiting user: ", user.Name())
 			return
-		default:
-			msg := <-user.sender
-			_, err := conn.Write([]byte(msg))
-			if err != nil {
-				log.Println("Sending exit for user: ", string(user.name))
-				user.exit <- true
-				return
+		case <-user.outbox.Ready():
+			for _, msg := range user.outbox.Drain() {
+				_, err := conn.Write([]byte(user.render(msg)))
+				if err != nil {
+					log.Println("Can't write, exiting user: ", user.Name())
+					return
+				}
 			}
 		}
+	}
+}
+
+// Asks the room to remove the user and waits until everyone has been told
+func (cr *ChatRoom) UserLeave(user *User) {
+	log.Println("Calling leave on :", user.Name())
+	done := make(chan struct{})
+	cr.leave <- leaveRequest{user: user, done: done}
+	<-done
+}
+
+// Asks the room to add the user, returns an error if the name is taken
+func (cr *ChatRoom) AddUser(user *User) error {
+	result := make(chan error, 1)
+	cr.join <- joinRequest{user: user, result: result}
+	return <-result
+}
 
+// Runs fn on the room goroutine and waits for it to finish, so fn may
+// safely read and change the room state
+func (cr *ChatRoom) do(fn func()) {
+	done := make(chan struct{})
+	cr.ops <- func() {
+		fn()
+		close(done)
 	}
+	<-done
+}
 
+// Returns the names of everyone currently in the room
+func (cr *ChatRoom) UserNames() []string {
+	var names []string
+	cr.do(func() {
+		for _, u := range cr.users {
+			names = append(names, u.Name())
+		}
+	})
+	return names
 }
 
-func (cr *ChatRoom) UserLeave(user *User) {
-	log.Println("Calling leave on :", string(user.name))
+// Returns the amount of users currently in the room
+func (cr *ChatRoom) AmountUsers() int32 {
+	var amount int32
+	cr.do(func() {
+		amount = cr.amountUsers
+	})
+	return amount
+}
 
-	// Find slice index of user
-	var removeUserIndex uint32
-	for i, u := range cr.users {
-		if string(user.name) == string(u.name) {
-			removeUserIndex = uint32(i)
-			break
+// Event loop of the room. This is the only goroutine that ever touches
+// cr.users, everyone else has to go through the channels.
+func (cr *ChatRoom) Run() {
+	for {
+		select {
+		case req := <-cr.join:
+			req.result <- cr.addUser(req.user)
+		case req := <-cr.leave:
+			cr.removeUser(req.user)
+			close(req.done)
+		case message := <-cr.sendMessage:
+			cr.spreadMessage(message)
+		case fn := <-cr.ops:
+			fn()
 		}
 	}
+}
+
+func (cr *ChatRoom) removeUser(user *User) {
+	// Find slice index of user
+	removeUserIndex := slices.Index(cr.users, user)
+	if removeUserIndex < 0 {
+		return
+	}
 
 	// Remove user from slice
-	cr.users = slices.Delete(cr.users, int(removeUserIndex), int(removeUserIndex+1))
+	cr.users = slices.Delete(cr.users, removeUserIndex, removeUserIndex+1)
+	cr.amountUsers--
 
-	// Send everyone a message that user left ()
-	leaveMessage := fmt.Sprintf(UserLeavesMessage, user.name)
-	for _, u := range cr.users {
-		u.sender <- leaveMessage
-	}
+	// Send everyone a message that user left
+	leave := Message{kind: LeaveMessage, senderName: user.Name()}
+	cr.transcript.Record(leave)
+	cr.broadcast(leave, nil)
 }
 
-func (cr *ChatRoom) AddUser(user *User) error {
-	for _, otherUser := range cr.users {
-		if string(otherUser.name) == string(user.name) {
-			user.exit <- true
-			return errors.New("username already exists in chat room")
-		}
-	}
-	log.Printf("User %s Joined. ", user.name)
+var ErrNameTaken = errors.New("username already exists in chat room")
 
-	announceUserMessage := fmt.Sprintf(UserJoinedMessage, string(user.name))
+func (cr *ChatRoom) addUser(user *User) error {
+	if cr.findUser(user.Name()) != nil {
+		return ErrNameTaken
+	}
+	log.Printf("User %s Joined. ", user.Name())
 
 	// Construct message that contains all users in room
-	messageToNewUser := "* Users in Room: "
+	messageToNewUser := cr.userList(user)
 
 	// Announce to everyone
-	for _, otherUser := range cr.users {
-		if string(otherUser.name) != string(user.name) {
-			otherUser.sender <- announceUserMessage
-		}
-		messageToNewUser += fmt.Sprintf("%s, ", otherUser.name)
-	}
-	messageToNewUser = strings.TrimSuffix(messageToNewUser, ", ") + "\n"
+	join := Message{kind: JoinMessage, senderName: user.Name()}
+	cr.transcript.Record(join)
+	cr.broadcast(join, nil)
 
 	cr.users = append(cr.users, user)
 	cr.amountUsers++
+	cr.stats.Joins++
 
 	// Finally send new user msg of all users that are in the room
-	user.sender <- messageToNewUser
+	user.outbox.Push(messageToNewUser)
+
+	// And what they missed, leaving room in the outbox so the replay
+	// can't push out the user list or get them disconnected
+	entries := cr.history.Entries()
+	maxReplay := cr.config.QueueSize - 1
+	if maxReplay < 0 {
+		maxReplay = 0
+	}
+	if len(entries) > maxReplay {
+		entries = entries[len(entries)-maxReplay:]
+	}
+	for _, entry := range entries {
+		user.outbox.Push(Message{kind: SystemMessage, message: entry.String()})
+	}
 	return nil
 }
 
-func (cr *ChatRoom) HandleMessageSpreading() {
-	for {
-		message := <-cr.sendMessage
+// Constructs the "* Users in Room" message, leaving out except
+func (cr *ChatRoom) userList(except *User) Message {
+	var names []string
+	for _, otherUser := range cr.users {
+		if otherUser != except {
+			names = append(names, otherUser.Name())
+		}
+	}
+	return Message{kind: UserListMessage, message: strings.Join(names, ", ")}
+}
 
-		formattedMessage := fmt.Sprintf("[%s] %s", message.senderName, message.message)
-		// Send to all users but sender
-		for _, user := range cr.users {
-			if string(user.name) != message.senderName {
-				user.sender <- formattedMessage
-			}
+func (cr *ChatRoom) spreadMessage(message Message) {
+	// Find sender, it doesn't get its own message back
+	sender := message.sender
+	if sender == nil {
+		sender = cr.findUser(message.senderName)
+	} else {
+		message.senderName = sender.Name()
+	}
+	cr.stats.Messages++
+	cr.history.Add(message)
+	cr.transcript.Record(message)
+	cr.broadcast(message, sender)
+}
+
+// Returns the user with the given name or nil
+func (cr *ChatRoom) findUser(name string) *User {
+	for _, user := range cr.users {
+		if cr.sameName(user.Name(), name) {
+			return user
+		}
+	}
+	return nil
+}
+
+func (cr *ChatRoom) sameName(a string, b string) bool {
+	if cr.config.CaseInsensitiveNames {
+		return strings.EqualFold(a, b)
+	}
+	return a == b
+}
+
+// Whether someone other than except already uses name
+func (cr *ChatRoom) NameTaken(name string, except *User) bool {
+	var taken bool
+	cr.do(func() {
+		user := cr.findUser(name)
+		taken = user != nil && user != except
+	})
+	return taken
+}
+
+// Validates name and applies the room's username policy, returns the
+// name the user will be known as
+func (cr *ChatRoom) CheckUsername(name string) (string, error) {
+	if err := ValidateUsername(name); err != nil {
+		return "", err
+	}
+	if cr.config.UsernamePolicy != nil {
+		var err error
+		name, err = cr.config.UsernamePolicy.Check(name)
+		if err != nil {
+			return "", err
 		}
+	}
+	if cr.bans.NameBanned(name) {
+		return "", errors.New("username is banned")
+	}
+	return name, nil
+}
 
+// Queues message for every user in the room except the given one. Never
+// blocks, slow users are handled by their outbox.
+func (cr *ChatRoom) broadcast(message Message, except *User) {
+	for _, user := range cr.users {
+		if user != except {
+			user.outbox.Push(message)
+		}
 	}
 }
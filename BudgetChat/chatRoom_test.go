@@ -0,0 +1,103 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+)
+
+// Creates a user whose outbox is drained until the returned func is called
+func newTestUser(name string, chatRoom *ChatRoom) (*User, func()) {
+	user := NewUser(name, chatRoom)
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for {
+			select {
+			case <-user.outbox.Ready():
+				user.outbox.Drain()
+			case <-stop:
+				return
+			}
+		}
+	}()
+	return user, func() {
+		close(stop)
+		<-done
+	}
+}
+
+func TestAddUserRejectsDuplicate(t *testing.T) {
+	chatRoom := NewChatRoom(DefaultRoomConfig())
+	go chatRoom.Run()
+
+	alice, stopAlice := newTestUser("alice", chatRoom)
+	defer stopAlice()
+	otherAlice, stopOtherAlice := newTestUser("alice", chatRoom)
+	defer stopOtherAlice()
+
+	if err := chatRoom.AddUser(alice); err != nil {
+		t.Fatal(err)
+	}
+	if err := chatRoom.AddUser(otherAlice); err == nil {
+		t.Error("Adding a second alice should fail")
+	}
+	if n := chatRoom.AmountUsers(); n != 1 {
+		t.Errorf("expected 1 user, got %d", n)
+	}
+}
+
+func TestUserLeaveUnknownUser(t *testing.T) {
+	chatRoom := NewChatRoom(DefaultRoomConfig())
+	go chatRoom.Run()
+
+	alice, stopAlice := newTestUser("alice", chatRoom)
+	defer stopAlice()
+	bob, stopBob := newTestUser("bob", chatRoom)
+	defer stopBob()
+
+	if err := chatRoom.AddUser(alice); err != nil {
+		t.Fatal(err)
+	}
+
+	// Bob never joined, so alice has to stay
+	chatRoom.UserLeave(bob)
+	names := chatRoom.UserNames()
+	if len(names) != 1 || names[0] != "alice" {
+		t.Errorf("expected [alice], got %v", names)
+	}
+}
+
+func TestConcurrentJoinAndLeave(t *testing.T) {
+	const amountUsers = 500
+
+	chatRoom := NewChatRoom(DefaultRoomConfig())
+	go chatRoom.Run()
+
+	var wg sync.WaitGroup
+	for i := 0; i < amountUsers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			user, stop := newTestUser(fmt.Sprintf("user%d", i), chatRoom)
+			defer stop()
+
+			if err := chatRoom.AddUser(user); err != nil {
+				t.Error(err)
+				return
+			}
+			chatRoom.sendMessage <- Message{senderName: user.Name(), message: "hi\n"}
+			chatRoom.UserNames()
+			chatRoom.UserLeave(user)
+		}(i)
+	}
+	wg.Wait()
+
+	if n := chatRoom.AmountUsers(); n != 0 {
+		t.Errorf("expected empty room, got %d users", n)
+	}
+	if names := chatRoom.UserNames(); len(names) != 0 {
+		t.Errorf("expected empty room, got %v", names)
+	}
+}
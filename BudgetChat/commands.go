@@ -0,0 +1,144 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// A parsed slash command, e.g. "/msg bob hi there"
+type Command struct {
+	name string
+	// Recipient of /msg or the new name of /nick
+	target string
+	// Text of /msg or the action of /me
+	text string
+}
+
+// Lines starting with a slash are commands instead of chat messages
+func IsCommand(line string) bool {
+	return strings.HasPrefix(line, "/")
+}
+
+func ParseCommand(line string) (Command, error) {
+	line = strings.TrimRight(line, "\r\n")
+	name, rest, _ := strings.Cut(strings.TrimPrefix(line, "/"), " ")
+	rest = strings.TrimSpace(rest)
+	cmd := Command{name: name}
+
+	switch name {
+	case "msg":
+		target, text, _ := strings.Cut(rest, " ")
+		text = strings.TrimSpace(text)
+		if target == "" || text == "" {
+			return cmd, errors.New("usage: /msg <user> <text>")
+		}
+		cmd.target = target
+		cmd.text = text
+	case "me":
+		if rest == "" {
+			return cmd, errors.New("usage: /me <action>")
+		}
+		cmd.text = rest
+	case "nick":
+		if rest == "" {
+			return cmd, errors.New("usage: /nick <newname>")
+		}
+		if err := ValidateUsername(rest); err != nil {
+			return cmd, err
+		}
+		cmd.target = rest
+	case "who", "help":
+	default:
+		return cmd, fmt.Errorf("unknown command /%s, try /help", name)
+	}
+	return cmd, nil
+}
+
+// Parses and executes a command line typed by user. Errors only go back to
+// the user who typed it.
+func (cr *ChatRoom) RunCommand(user *User, line string) {
+	cmd, err := ParseCommand(line)
+	if err != nil {
+		user.outbox.Push(errorMessage(err))
+		return
+	}
+	cr.do(func() {
+		cr.runCommand(user, cmd)
+	})
+}
+
+func errorMessage(err error) Message {
+	return Message{kind: SystemMessage, message: fmt.Sprintf(CommandErrorMessage, err)}
+}
+
+// Runs on the room goroutine
+func (cr *ChatRoom) runCommand(user *User, cmd Command) {
+	switch cmd.name {
+	case "msg":
+		recipient := cr.findUser(cmd.target)
+		if recipient == nil {
+			user.outbox.Push(errorMessage(fmt.Errorf("no user named %s", cmd.target)))
+			return
+		}
+		recipient.outbox.Push(Message{
+			kind:       PrivateMessage,
+			senderName: user.Name(),
+			message:    cmd.text + "\n",
+		})
+
+	case "who":
+		user.outbox.Push(cr.userList(nil))
+
+	case "me":
+		action := Message{
+			kind:       ActionMessage,
+			senderName: user.Name(),
+			message:    cmd.text + "\n",
+		}
+		cr.history.Add(action)
+		cr.transcript.Record(action)
+		cr.broadcast(action, user)
+
+	case "nick":
+		if err := cr.rename(user, cmd.target); err != nil {
+			user.outbox.Push(errorMessage(err))
+		}
+
+	case "help":
+		user.outbox.Push(Message{kind: SystemMessage, message: HelpMessage})
+	}
+}
+
+// Names with a password can only be had by logging in with them
+var ErrNameRegistered = errors.New("username is registered, reconnect to log in")
+
+// Does what /nick does, but the error goes back to the caller instead of
+// the user's outbox
+func (cr *ChatRoom) Rename(user *User, name string) error {
+	var err error
+	cr.do(func() {
+		err = cr.rename(user, name)
+	})
+	return err
+}
+
+// Runs on the room goroutine
+func (cr *ChatRoom) rename(user *User, name string) error {
+	newName, err := cr.CheckUsername(name)
+	if err != nil {
+		return err
+	}
+	if cr.config.Passwords.Has(newName) {
+		return ErrNameRegistered
+	}
+	if other := cr.findUser(newName); other != nil && other != user {
+		return ErrNameTaken
+	}
+	oldName := user.Name()
+	user.setName(newName)
+	nick := Message{kind: NickMessage, senderName: oldName, message: newName}
+	cr.transcript.Record(nick)
+	cr.broadcast(nick, nil)
+	return nil
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"testing"
+)
+
+func TestParseCommand(t *testing.T) {
+	type test struct {
+		Line    string
+		Command Command
+		Error   bool
+	}
+
+	testCases := []test{
+		{Line: "/msg bob hi there\n", Command: Command{name: "msg", target: "bob", text: "hi there"}},
+		{Line: "/msg bob\n", Error: true},
+		{Line: "/msg\n", Error: true},
+		{Line: "/who\n", Command: Command{name: "who"}},
+		{Line: "/help\r\n", Command: Command{name: "help"}},
+		{Line: "/me waves at everyone\n", Command: Command{name: "me", text: "waves at everyone"}},
+		{Line: "/me \n", Error: true},
+		{Line: "/nick alice2\n", Command: Command{name: "nick", target: "alice2"}},
+		{Line: "/nick al!ce\n", Error: true},
+		{Line: "/nick\n", Error: true},
+		{Line: "/dance\n", Error: true},
+		{Line: "/\n", Error: true},
+	}
+
+	for _, tc := range testCases {
+		cmd, err := ParseCommand(tc.Line)
+		if tc.Error {
+			if err == nil {
+				t.Errorf("Line: %q, expected error, got %+v", tc.Line, cmd)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Line: %q, unexpected error: %v", tc.Line, err)
+			continue
+		}
+		if cmd != tc.Command {
+			t.Errorf("Line: %q, expected: %+v, got: %+v", tc.Line, tc.Command, cmd)
+		}
+	}
+}
+
+func TestCommands(t *testing.T) {
+	addr, _ := startTestServer(t, DefaultRoomConfig())
+
+	alice, aliceReader, _ := joinTestClient(t, addr, "alice")
+	defer alice.Close()
+	bob, bobReader, _ := joinTestClient(t, addr, "bob")
+	defer bob.Close()
+	carol, carolReader, _ := joinTestClient(t, addr, "carol")
+	defer carol.Close()
+	expectLine(t, aliceReader, "* bob joined this chat room\n")
+	expectLine(t, aliceReader, "* carol joined this chat room\n")
+	expectLine(t, bobReader, "* carol joined this chat room\n")
+
+	// Private messages only reach their recipient
+	fmt.Fprint(alice, "/msg bob psst\n")
+	expectLine(t, bobReader, "[alice -> you] psst\n")
+
+	fmt.Fprint(alice, "/msg dave psst\n")
+	expectLine(t, aliceReader, "* Error: no user named dave\n")
+
+	fmt.Fprint(bob, "/who\n")
+	expectLine(t, bobReader, "* Users in Room: alice, bob, carol\n")
+
+	fmt.Fprint(bob, "/me waves\n")
+	expectLine(t, aliceReader, "* bob waves\n")
+	expectLine(t, carolReader, "* bob waves\n")
+
+	// Unknown commands and invalid names are only answered to the sender
+	fmt.Fprint(carol, "/dance\n")
+	expectLine(t, carolReader, "* Error: unknown command /dance, try /help\n")
+	fmt.Fprint(carol, "/nick bob\n")
+	expectLine(t, carolReader, "* Error: username already exists in chat room\n")
+
+	fmt.Fprint(carol, "/nick dave\n")
+	for _, reader := range []*bufio.Reader{aliceReader, bobReader, carolReader} {
+		expectLine(t, reader, "* carol is now known as dave\n")
+	}
+
+	// Messages now come from the new name, private messages find it too
+	fmt.Fprint(carol, "hello\n")
+	expectLine(t, aliceReader, "[dave] hello\n")
+	fmt.Fprint(alice, "/msg dave hi dave\n")
+	expectLine(t, carolReader, "[alice -> you] hi dave\n")
+
+	// Nobody saw the errors or the private messages
+	fmt.Fprint(carol, "bye\n")
+	expectLine(t, aliceReader, "[dave] bye\n")
+	expectLine(t, bobReader, "[dave] hello\n")
+	expectLine(t, bobReader, "[dave] bye\n")
+}
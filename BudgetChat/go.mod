@@ -2,4 +2,11 @@ module lightstack.ml/budgetChat
 
 go 1.18
 
-require golang.org/x/exp v0.0.0-20220921164117-439092de6870 
+require (
+	golang.org/x/crypto v0.24.0
+	golang.org/x/exp v0.0.0-20220921164117-439092de6870
+	golang.org/x/text v0.22.0
+	lightstack.ml/tlsutil v0.0.0
+)
+
+replace lightstack.ml/tlsutil => ../TLSUtil
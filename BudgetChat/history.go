@@ -0,0 +1,173 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"time"
+)
+
+// One remembered message
+type HistoryEntry struct {
+	Time    time.Time   `json:"time"`
+	Kind    MessageKind `json:"kind"`
+	Sender  string      `json:"sender"`
+	Message string      `json:"message"`
+}
+
+// Formats the entry for replaying it to someone who just joined. It starts
+// with a '*' so clients treat it like any other server message.
+func (e HistoryEntry) String() string {
+	msg := Message{kind: e.Kind, senderName: e.Sender, message: e.Message}
+	return fmt.Sprintf(HistoryMessageFormat, e.Time.Format("15:04:05"), msg.String())
+}
+
+// Ring buffer of the last few messages of a room, optionally backed by a
+// file so it survives restarts. Only used from the room goroutine.
+type History struct {
+	entries []HistoryEntry
+	start   int
+	count   int
+	file    *os.File
+	path    string
+	// Entries in the file, older ones included
+	lines int
+}
+
+// Sizes below 1 disable the history
+func NewHistory(size int) *History {
+	if size < 0 {
+		size = 0
+	}
+	return &History{entries: make([]HistoryEntry, size)}
+}
+
+// Loads the last size entries from path and appends every new entry to it.
+// The file is rewritten whenever it holds twice as many entries as we
+// remember, so it doesn't grow forever.
+func LoadHistory(path string, size int) (*History, error) {
+	h := NewHistory(size)
+	h.path = path
+
+	file, err := os.Open(path)
+	if err == nil {
+		scanner := bufio.NewScanner(file)
+		for scanner.Scan() {
+			var entry HistoryEntry
+			if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+				log.Println("Skipping broken history line: ", err)
+				continue
+			}
+			h.add(entry)
+		}
+		file.Close()
+		if err := scanner.Err(); err != nil {
+			return nil, err
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	if err := h.compact(); err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+// Rewrites the file down to what we still remember
+func (h *History) compact() error {
+	tempPath := h.path + ".tmp"
+	file, err := os.Create(tempPath)
+	if err != nil {
+		return err
+	}
+	for _, entry := range h.Entries() {
+		if err := writeHistoryEntry(file, entry); err != nil {
+			file.Close()
+			return err
+		}
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tempPath, h.path); err != nil {
+		return err
+	}
+
+	file, err = os.OpenFile(h.path, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	if h.file != nil {
+		h.file.Close()
+	}
+	h.file = file
+	h.lines = h.count
+	return nil
+}
+
+func writeHistoryEntry(file *os.File, entry HistoryEntry) error {
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	_, err = file.Write(append(line, '\n'))
+	return err
+}
+
+// Remembers msg, forgetting the oldest entry if the buffer is full
+func (h *History) Add(msg Message) {
+	entry := HistoryEntry{
+		Time:    time.Now(),
+		Kind:    msg.kind,
+		Sender:  msg.senderName,
+		Message: msg.message,
+	}
+	h.add(entry)
+
+	if h.file == nil || len(h.entries) == 0 {
+		return
+	}
+	if err := writeHistoryEntry(h.file, entry); err != nil {
+		log.Println("Can't persist history: ", err)
+		return
+	}
+	h.lines++
+	if h.lines >= 2*len(h.entries) {
+		if err := h.compact(); err != nil {
+			// Appending still works, try again next time
+			log.Println("Can't compact history: ", err)
+		}
+	}
+}
+
+func (h *History) add(entry HistoryEntry) {
+	if len(h.entries) == 0 {
+		return
+	}
+	end := (h.start + h.count) % len(h.entries)
+	h.entries[end] = entry
+	if h.count < len(h.entries) {
+		h.count++
+	} else {
+		h.start = (h.start + 1) % len(h.entries)
+	}
+}
+
+// Returns the remembered entries, oldest first
+func (h *History) Entries() []HistoryEntry {
+	entries := make([]HistoryEntry, 0, h.count)
+	for i := 0; i < h.count; i++ {
+		entries = append(entries, h.entries[(h.start+i)%len(h.entries)])
+	}
+	return entries
+}
+
+func (h *History) Close() error {
+	if h.file == nil {
+		return nil
+	}
+	return h.file.Close()
+}
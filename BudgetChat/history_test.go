@@ -0,0 +1,135 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func historyMessages(h *History) []string {
+	var msgs []string
+	for _, entry := range h.Entries() {
+		msgs = append(msgs, entry.Message)
+	}
+	return msgs
+}
+
+func TestHistoryRingBuffer(t *testing.T) {
+	history := NewHistory(3)
+	for i := 0; i < 5; i++ {
+		history.Add(Message{senderName: "alice", message: fmt.Sprint(i)})
+	}
+
+	msgs := historyMessages(history)
+	if strings.Join(msgs, ",") != "2,3,4" {
+		t.Errorf("expected 2,3,4, got %v", msgs)
+	}
+}
+
+func TestHistoryDisabled(t *testing.T) {
+	for _, size := range []int{0, -1} {
+		history := NewHistory(size)
+		history.Add(Message{senderName: "alice", message: "hi"})
+		if len(history.Entries()) != 0 {
+			t.Errorf("History of size %d should not remember anything", size)
+		}
+	}
+}
+
+func TestHistoryPersists(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "history.jsonl")
+
+	history, err := LoadHistory(path, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 4; i++ {
+		history.Add(Message{senderName: "alice", message: fmt.Sprint(i)})
+	}
+	history.Add(Message{kind: ActionMessage, senderName: "bob", message: "waves\n"})
+	history.Close()
+
+	// A smaller buffer after the restart keeps only the newest entries
+	history, err = LoadHistory(path, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer history.Close()
+
+	entries := history.Entries()
+	if len(entries) != 2 {
+		t.Fatalf("expected 2 entries, got %d", len(entries))
+	}
+	if entries[0].Message != "3" || entries[1].Kind != ActionMessage || entries[1].Sender != "bob" {
+		t.Errorf("unexpected entries after reload: %+v", entries)
+	}
+}
+
+// A room that runs for a long time doesn't keep every message it ever saw
+func TestHistoryCompactsWhileRunning(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "history.jsonl")
+
+	history, err := LoadHistory(path, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 100; i++ {
+		history.Add(Message{senderName: "alice", message: fmt.Sprint(i)})
+	}
+	history.Close()
+
+	content, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lines := strings.Count(string(content), "\n"); lines > 6 {
+		t.Errorf("expected at most 6 entries in the file, got %d", lines)
+	}
+
+	history, err = LoadHistory(path, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer history.Close()
+	if msgs := historyMessages(history); strings.Join(msgs, ",") != "97,98,99" {
+		t.Errorf("expected 97,98,99, got %v", msgs)
+	}
+}
+
+func TestHistoryReplayedToNewUser(t *testing.T) {
+	addr, _ := startTestServer(t, DefaultRoomConfig())
+
+	alice, _, _ := joinTestClient(t, addr, "alice")
+	defer alice.Close()
+	bob, bobReader, _ := joinTestClient(t, addr, "bob")
+	defer bob.Close()
+
+	fmt.Fprint(alice, "hello\n")
+	fmt.Fprint(alice, "/me waves\n")
+	fmt.Fprint(alice, "/msg bob secret\n")
+	expectLine(t, bobReader, "[alice] hello\n")
+	expectLine(t, bobReader, "* alice waves\n")
+	expectLine(t, bobReader, "[alice -> you] secret\n")
+
+	carol, carolReader, userList := joinTestClient(t, addr, "carol")
+	defer carol.Close()
+	if userList != "* Users in Room: alice, bob\n" {
+		t.Errorf("user list has to come first, got %q", userList)
+	}
+
+	// Private messages are not part of the history
+	for _, expected := range []string{"[alice] hello\n", "* alice waves\n"} {
+		line, err := carolReader.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.HasPrefix(line, "* history ") || !strings.HasSuffix(line, " "+expected) {
+			t.Errorf("expected replay of %q, got %q", expected, line)
+		}
+	}
+
+	fmt.Fprint(bob, "hi carol\n")
+	expectLine(t, carolReader, "[bob] hi carol\n")
+}
@@ -0,0 +1,384 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"sync"
+)
+
+// IRC clients see the chat room as a single channel on a single server
+const (
+	IRCServerName    = "budgetchat"
+	IRCChannel       = "#budgetchat"
+	MaxIRCLineLength = 512
+)
+
+// Numeric replies of RFC 2812 we actually use
+const (
+	rplWelcome          = "001"
+	rplNamReply         = "353"
+	rplEndOfNames       = "366"
+	errNoSuchNick       = "401"
+	errNoSuchChannel    = "403"
+	errUnknownCommand   = "421"
+	errNoMotd           = "422"
+	errNoNicknameGiven  = "431"
+	errErroneusNickname = "432"
+	errNicknameInUse    = "433"
+	errNotOnChannel     = "442"
+	errNotRegistered    = "451"
+	errNeedMoreParams   = "461"
+	errPasswdMismatch   = "464"
+)
+
+// One line from an IRC client, e.g. "PRIVMSG #budgetchat :hi there"
+type ircMessage struct {
+	command string
+	params  []string
+}
+
+func parseIRCLine(line string) ircMessage {
+	line = strings.TrimRight(line, "\r\n")
+
+	// Clients may send a prefix, it means nothing coming from them
+	if strings.HasPrefix(line, ":") {
+		_, line, _ = strings.Cut(line, " ")
+	}
+
+	var msg ircMessage
+	line, trailing, hasTrailing := strings.Cut(line, " :")
+	fields := strings.Fields(line)
+	if len(fields) > 0 {
+		msg.command = strings.ToUpper(fields[0])
+		msg.params = fields[1:]
+	}
+	if hasTrailing {
+		msg.params = append(msg.params, trailing)
+	}
+	return msg
+}
+
+// Bridges one IRC connection into the chat room
+type ircClient struct {
+	conn     net.Conn
+	chatRoom *ChatRoom
+
+	// Registration state, user exists once both NICK and USER were sent
+	nick     string
+	pass     string
+	gotUser  bool
+	user     *User
+	joined   bool
+	quitting bool
+}
+
+// Writes one line, a single Write so lines from the send handler don't
+// get mixed into it
+func (c *ircClient) send(format string, args ...interface{}) {
+	c.conn.Write([]byte(fmt.Sprintf(format, args...) + "\r\n"))
+}
+
+func (c *ircClient) numeric(code string, params string) {
+	nick := c.nick
+	if nick == "" {
+		nick = "*"
+	}
+	c.send(":%s %s %s %s", IRCServerName, code, nick, params)
+}
+
+func ircPrefix(nick string) string {
+	return fmt.Sprintf("%s!%s@%s", nick, nick, IRCServerName)
+}
+
+// Translates what the chat room says into IRC
+func (c *ircClient) format(msg Message) string {
+	me := c.user.Name()
+	text := strings.TrimSuffix(msg.message, "\n")
+
+	var lines []string
+	switch msg.kind {
+	case ChatMessage:
+		lines = append(lines, fmt.Sprintf(":%s PRIVMSG %s :%s", ircPrefix(msg.senderName), IRCChannel, text))
+	case ActionMessage:
+		lines = append(lines, fmt.Sprintf(":%s PRIVMSG %s :\x01ACTION %s\x01", ircPrefix(msg.senderName), IRCChannel, text))
+	case PrivateMessage:
+		lines = append(lines, fmt.Sprintf(":%s PRIVMSG %s :%s", ircPrefix(msg.senderName), me, text))
+	case JoinMessage:
+		lines = append(lines, fmt.Sprintf(":%s JOIN %s", ircPrefix(msg.senderName), IRCChannel))
+	case LeaveMessage:
+		lines = append(lines, fmt.Sprintf(":%s PART %s", ircPrefix(msg.senderName), IRCChannel))
+	case NickMessage:
+		lines = append(lines, fmt.Sprintf(":%s NICK :%s", ircPrefix(msg.senderName), text))
+	case UserListMessage:
+		// The room greets everyone who joins with the user list, which is
+		// where an IRC client expects its own JOIN followed by the names
+		names := []string{me}
+		if text != "" {
+			names = append(names, strings.Split(text, ", ")...)
+		}
+		lines = append(lines, fmt.Sprintf(":%s JOIN %s", ircPrefix(me), IRCChannel))
+		lines = append(lines, namesReply(me, names)...)
+	default:
+		lines = append(lines, fmt.Sprintf(":%s NOTICE %s :%s", IRCServerName, me, text))
+	}
+	return strings.Join(lines, "\r\n") + "\r\n"
+}
+
+func namesReply(nick string, names []string) []string {
+	return []string{
+		fmt.Sprintf(":%s %s %s = %s :%s", IRCServerName, rplNamReply, nick, IRCChannel, strings.Join(names, " ")),
+		fmt.Sprintf(":%s %s %s %s :End of /NAMES list.", IRCServerName, rplEndOfNames, nick, IRCChannel),
+	}
+}
+
+func handleIRCConnection(conn net.Conn, chatRoom *ChatRoom) {
+	defer conn.Close()
+	if !chatRoom.connections.Acquire(conn.RemoteAddr()) {
+		log.Println("Too many connections from ", conn.RemoteAddr())
+		fmt.Fprint(conn, "ERROR :Closing Link (too many connections)\r\n")
+		return
+	}
+	defer chatRoom.connections.Release(conn.RemoteAddr())
+	if chatRoom.bans.AddrBanned(conn.RemoteAddr()) {
+		log.Println("Banned address ", conn.RemoteAddr())
+		fmt.Fprint(conn, "ERROR :Closing Link (banned)\r\n")
+		return
+	}
+
+	c := &ircClient{conn: conn, chatRoom: chatRoom}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var wg sync.WaitGroup
+
+	scanner := bufio.NewScanner(conn)
+	scanner.Buffer(make([]byte, MaxIRCLineLength), MaxIRCLineLength)
+	for !c.quitting && scanner.Scan() {
+		c.handleLine(parseIRCLine(scanner.Text()))
+
+		// Registration done, from now on the room talks to the client too
+		if c.user == nil && c.nick != "" && c.gotUser {
+			if err := chatRoom.CheckPassword(c.nick, c.pass); err != nil {
+				log.Printf("Authentication of %s failed: %v", c.nick, err)
+				c.numeric(errPasswdMismatch, ":Password incorrect")
+				c.send("ERROR :Closing Link (%s)", err)
+				break
+			}
+			c.user = NewUser(c.nick, chatRoom)
+			c.user.addr = conn.RemoteAddr()
+			c.user.format = c.format
+			c.numeric(rplWelcome, fmt.Sprintf(":Welcome to this DeLightFull Chat Room %s, JOIN %s to chat", c.nick, IRCChannel))
+			c.numeric(errNoMotd, ":MOTD File is missing")
+
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				// Unblocks the scanner if the client can't keep up
+				defer conn.Close()
+				c.user.StartSendHandler(ctx, conn)
+			}()
+		}
+	}
+
+	cancel()
+	conn.Close()
+	wg.Wait()
+	if c.joined {
+		log.Println("Leaving: ", c.user.Name())
+		chatRoom.UserLeave(c.user)
+	}
+}
+
+func (c *ircClient) handleLine(msg ircMessage) {
+	switch msg.command {
+	case "":
+		return
+	case "PING":
+		c.send(":%s PONG %s :%s", IRCServerName, IRCServerName, strings.Join(msg.params, " "))
+		return
+	case "PONG", "CAP":
+		return
+	case "PASS":
+		if len(msg.params) < 1 {
+			c.numeric(errNeedMoreParams, "PASS :Not enough parameters")
+			return
+		}
+		c.pass = msg.params[0]
+		return
+	case "QUIT":
+		c.send("ERROR :Closing Link")
+		c.quitting = true
+		return
+	case "NICK":
+		c.handleNick(msg)
+		return
+	case "USER":
+		if len(msg.params) < 4 {
+			c.numeric(errNeedMoreParams, "USER :Not enough parameters")
+			return
+		}
+		c.gotUser = true
+		return
+	}
+
+	if c.user == nil {
+		c.numeric(errNotRegistered, ":You have not registered")
+		return
+	}
+
+	switch msg.command {
+	case "JOIN":
+		c.handleJoin(msg)
+	case "PART":
+		c.handlePart(msg)
+	case "NAMES":
+		c.send("%s", strings.Join(namesReply(c.nick, c.chatRoom.UserNames()), "\r\n"))
+	case "PRIVMSG":
+		c.handlePrivmsg(msg)
+	default:
+		c.numeric(errUnknownCommand, msg.command+" :Unknown command")
+	}
+}
+
+func (c *ircClient) handleNick(msg ircMessage) {
+	if len(msg.params) < 1 {
+		c.numeric(errNoNicknameGiven, ":No nickname given")
+		return
+	}
+	if c.joined {
+		// The room checks the name and tells everyone including us. The
+		// nick only changes once it agreed.
+		if err := c.chatRoom.Rename(c.user, msg.params[0]); err != nil {
+			c.nickRejected(msg.params[0], err)
+			return
+		}
+		c.nick = c.user.Name()
+		return
+	}
+
+	nick, err := c.chatRoom.CheckUsername(msg.params[0])
+	if err != nil {
+		c.numeric(errErroneusNickname, msg.params[0]+" :Erroneous nickname")
+		return
+	}
+	if c.chatRoom.NameTaken(nick, c.user) {
+		c.numeric(errNicknameInUse, nick+" :Nickname is already in use")
+		return
+	}
+	// Registered names can only be had with PASS before registering
+	if c.user != nil && c.chatRoom.config.Passwords.Has(nick) {
+		c.numeric(errNicknameInUse, nick+" :Nickname is registered")
+		return
+	}
+
+	if c.user != nil {
+		c.send(":%s NICK :%s", ircPrefix(c.nick), nick)
+		c.user.setName(nick)
+	}
+	c.nick = nick
+}
+
+// Tells the client why the room refused its new nick
+func (c *ircClient) nickRejected(nick string, err error) {
+	switch err {
+	case ErrNameTaken:
+		c.numeric(errNicknameInUse, nick+" :Nickname is already in use")
+	case ErrNameRegistered:
+		c.numeric(errNicknameInUse, nick+" :Nickname is registered")
+	default:
+		c.numeric(errErroneusNickname, nick+" :Erroneous nickname")
+	}
+}
+
+func (c *ircClient) handleJoin(msg ircMessage) {
+	if len(msg.params) < 1 {
+		c.numeric(errNeedMoreParams, "JOIN :Not enough parameters")
+		return
+	}
+	for _, channel := range strings.Split(msg.params[0], ",") {
+		if channel != IRCChannel {
+			c.numeric(errNoSuchChannel, channel+" :No such channel")
+			continue
+		}
+		if c.joined {
+			continue
+		}
+		if err := c.chatRoom.AddUser(c.user); err != nil {
+			c.numeric(errNicknameInUse, c.user.Name()+" :Nickname is already in use")
+			continue
+		}
+		c.joined = true
+	}
+}
+
+func (c *ircClient) handlePart(msg ircMessage) {
+	if len(msg.params) < 1 {
+		c.numeric(errNeedMoreParams, "PART :Not enough parameters")
+		return
+	}
+	for _, channel := range strings.Split(msg.params[0], ",") {
+		if channel != IRCChannel {
+			c.numeric(errNoSuchChannel, channel+" :No such channel")
+			continue
+		}
+		if !c.joined {
+			c.numeric(errNotOnChannel, channel+" :You're not on that channel")
+			continue
+		}
+		c.chatRoom.UserLeave(c.user)
+		c.joined = false
+		c.send(":%s PART %s", ircPrefix(c.user.Name()), IRCChannel)
+	}
+}
+
+func (c *ircClient) handlePrivmsg(msg ircMessage) {
+	if len(msg.params) < 2 {
+		c.numeric(errNeedMoreParams, "PRIVMSG :Not enough parameters")
+		return
+	}
+	target, text := msg.params[0], msg.params[1]
+	if !c.user.allowMessage() {
+		return
+	}
+
+	// CTCP ACTION is what IRC clients send for /me
+	if strings.HasPrefix(text, "\x01ACTION ") {
+		text = strings.TrimSuffix(strings.TrimPrefix(text, "\x01ACTION "), "\x01")
+		if target == IRCChannel && c.joined {
+			c.chatRoom.RunCommand(c.user, "/me "+text)
+			return
+		}
+	}
+
+	if target == IRCChannel {
+		if !c.joined {
+			c.numeric(errNotOnChannel, IRCChannel+" :You're not on that channel")
+			return
+		}
+		c.chatRoom.sendMessage <- Message{sender: c.user, senderName: c.user.Name(), message: text + "\n"}
+		return
+	}
+
+	// Anything else is a private message to someone in the room
+	if !c.chatRoom.NameTaken(target, nil) || !c.joined {
+		c.numeric(errNoSuchNick, target+" :No such nick/channel")
+		return
+	}
+	c.chatRoom.RunCommand(c.user, fmt.Sprintf("/msg %s %s", target, text))
+}
+
+// Accepts IRC connections until the listener fails
+func ServeIRC(listen net.Listener, chatRoom *ChatRoom) error {
+	for {
+		conn, err := listen.Accept()
+		if err != nil {
+			return err
+		}
+		log.Println("Got IRC Connection")
+
+		go handleIRCConnection(conn, chatRoom)
+	}
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseIRCLine(t *testing.T) {
+	type test struct {
+		Line    string
+		Command string
+		Params  []string
+	}
+
+	testCases := []test{
+		{Line: "NICK alice\r\n", Command: "NICK", Params: []string{"alice"}},
+		{Line: "USER alice 0 * :Alice Liddell", Command: "USER", Params: []string{"alice", "0", "*", "Alice Liddell"}},
+		{Line: "privmsg #budgetchat :hi: there", Command: "PRIVMSG", Params: []string{"#budgetchat", "hi: there"}},
+		{Line: ":alice!a@host PART #budgetchat", Command: "PART", Params: []string{"#budgetchat"}},
+		{Line: "QUIT", Command: "QUIT"},
+		{Line: "", Command: ""},
+	}
+
+	for _, tc := range testCases {
+		msg := parseIRCLine(tc.Line)
+		if msg.command != tc.Command || fmt.Sprint(msg.params) != fmt.Sprint(tc.Params) {
+			t.Errorf("Line: %q, expected: %s %v, got: %s %v", tc.Line, tc.Command, tc.Params, msg.command, msg.params)
+		}
+	}
+}
+
+// Starts an IRC listener next to the TCP one, both using the same room
+func startTestIRCServer(t *testing.T, chatRoom *ChatRoom) string {
+	listen, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listen.Close() })
+	go ServeIRC(listen, chatRoom)
+	return listen.Addr().String()
+}
+
+type testIRCClient struct {
+	t      *testing.T
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+func dialTestIRC(t *testing.T, addr string) *testIRCClient {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	t.Cleanup(func() { conn.Close() })
+	return &testIRCClient{t: t, conn: conn, reader: bufio.NewReader(conn)}
+}
+
+func (c *testIRCClient) send(line string) {
+	fmt.Fprintf(c.conn, "%s\r\n", line)
+}
+
+func (c *testIRCClient) expect(lines ...string) {
+	c.t.Helper()
+	for _, expected := range lines {
+		expectLine(c.t, c.reader, expected+"\r\n")
+	}
+}
+
+func (c *testIRCClient) register(nick string) {
+	c.t.Helper()
+	c.send("CAP LS 302")
+	c.send("NICK " + nick)
+	c.send("USER " + nick + " 0 * :" + nick)
+	c.expect(
+		":budgetchat 001 "+nick+" :Welcome to this DeLightFull Chat Room "+nick+", JOIN #budgetchat to chat",
+		":budgetchat 422 "+nick+" :MOTD File is missing",
+	)
+}
+
+func TestIRCSession(t *testing.T) {
+	addr, chatRoom := startTestServer(t, DefaultRoomConfig())
+	ircAddr := startTestIRCServer(t, chatRoom)
+
+	alice, aliceReader, _ := joinTestClient(t, addr, "alice")
+	defer alice.Close()
+
+	bob := dialTestIRC(t, ircAddr)
+	bob.send("JOIN #budgetchat")
+	bob.expect(":budgetchat 451 * :You have not registered")
+	bob.register("bob")
+
+	bob.send("JOIN #elsewhere")
+	bob.expect(":budgetchat 403 bob #elsewhere :No such channel")
+	bob.send("JOIN #budgetchat")
+	bob.expect(
+		":bob!bob@budgetchat JOIN #budgetchat",
+		":budgetchat 353 bob = #budgetchat :bob alice",
+		":budgetchat 366 bob #budgetchat :End of /NAMES list.",
+	)
+	expectLine(t, aliceReader, "* bob joined this chat room\n")
+
+	// Chat both ways
+	bob.send("PRIVMSG #budgetchat :hello alice")
+	expectLine(t, aliceReader, "[bob] hello alice\n")
+	fmt.Fprint(alice, "hi bob\n")
+	bob.expect(":alice!alice@budgetchat PRIVMSG #budgetchat :hi bob")
+
+	bob.send("PRIVMSG #budgetchat :\x01ACTION waves\x01")
+	expectLine(t, aliceReader, "* bob waves\n")
+	fmt.Fprint(alice, "/msg bob psst\n")
+	bob.expect(":alice!alice@budgetchat PRIVMSG bob :psst")
+	bob.send("PRIVMSG alice :psst back")
+	expectLine(t, aliceReader, "[bob -> you] psst back\n")
+	bob.send("PRIVMSG carol :anyone?")
+	bob.expect(":budgetchat 401 bob carol :No such nick/channel")
+
+	bob.send("PING :12345")
+	bob.expect(":budgetchat PONG budgetchat :12345")
+	bob.send("NAMES #budgetchat")
+	bob.expect(
+		":budgetchat 353 bob = #budgetchat :alice bob",
+		":budgetchat 366 bob #budgetchat :End of /NAMES list.",
+	)
+
+	// A second IRC user and the system messages translated to IRC
+	carol := dialTestIRC(t, ircAddr)
+	carol.register("carol")
+	carol.send("NICK alice")
+	carol.expect(":budgetchat 433 carol alice :Nickname is already in use")
+	carol.send("JOIN #budgetchat")
+	carol.expect(
+		":carol!carol@budgetchat JOIN #budgetchat",
+		":budgetchat 353 carol = #budgetchat :carol alice bob",
+		":budgetchat 366 carol #budgetchat :End of /NAMES list.",
+	)
+
+	// The history replay comes as notices
+	for _, expected := range []string{"[bob] hello alice", "[alice] hi bob", "* bob waves"} {
+		line, err := carol.reader.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.HasPrefix(line, ":budgetchat NOTICE carol :* history ") || !strings.HasSuffix(line, " "+expected+"\r\n") {
+			t.Errorf("expected history notice of %q, got %q", expected, line)
+		}
+	}
+	bob.expect(":carol!carol@budgetchat JOIN #budgetchat")
+	expectLine(t, aliceReader, "* carol joined this chat room\n")
+
+	// Refused renames leave the nick alone
+	carol.send("NICK bob")
+	carol.expect(":budgetchat 433 carol bob :Nickname is already in use")
+	carol.send("NICK b@d")
+	carol.expect(":budgetchat 432 carol b@d :Erroneous nickname")
+
+	carol.send("NICK dave")
+	carol.expect(":carol!carol@budgetchat NICK :dave")
+	bob.expect(":carol!carol@budgetchat NICK :dave")
+	expectLine(t, aliceReader, "* carol is now known as dave\n")
+
+	carol.send("PART #budgetchat")
+	carol.expect(":dave!dave@budgetchat PART #budgetchat")
+	bob.expect(":dave!dave@budgetchat PART #budgetchat")
+	expectLine(t, aliceReader, "* dave left the chat room\n")
+
+	bob.send("QUIT :bye")
+	bob.expect("ERROR :Closing Link")
+	expectLine(t, aliceReader, "* bob left the chat room\n")
+	if names := chatRoom.UserNames(); len(names) != 1 || names[0] != "alice" {
+		t.Errorf("expected only alice to be left, got %v", names)
+	}
+}
@@ -1,11 +1,22 @@
 package main
 
 import (
+	"bufio"
+	"context"
 	"errors"
+	"flag"
+	"fmt"
 	"log"
 	"net"
+	"net/http"
+	"os"
 	"strings"
+	"sync"
+	"time"
 	"unicode"
+	"unicode/utf8"
+
+	"lightstack.ml/tlsutil"
 )
 
 const (
@@ -13,14 +24,69 @@ const (
 	Host = "0.0.0.0"
 	Port = "13337"
 
+	DefaultRoomName = "budgetchat"
+
 	MinUnameLength    = 1
 	MaxUnameLength    = 50
 	MaxMessageLength  = 1005
 	WelcomeMessage    = "Welcome to this DeLightFull Chat Room! What is your name?\n"
 	UserJoinedMessage = "* %s joined this chat room\n"
 	UserLeavesMessage = "* %s left the chat room\n"
+	UserListFormat    = "* Users in Room: %s\n"
+
+	DefaultQueueSize           = 128
+	DefaultHistorySize         = 20
+	DefaultMessageRate         = 0 // Off unless -rate turns it on
+	DefaultMessageBurst        = 10
+	DefaultFloodStrikes        = 5
+	DefaultMuteDuration        = 30 * time.Second
+	DefaultKickAfterMutes      = 3
+	DefaultMaxConnectionsPerIP = 0 // Off unless -max-conns-per-ip turns it on
+	LastWordsTimeout           = time.Second
+
+	PrivateMessageFormat = "[%s -> you] %s"
+	ActionMessageFormat  = "* %s %s"
+	NickChangedMessage   = "* %s is now known as %s\n"
+	CommandErrorMessage  = "* Error: %s\n"
+	HistoryMessageFormat = "* history %s %s"
+	NameRejectedMessage  = "* Name rejected: %s\n"
+	PasswordPrompt       = "* Password for %s?\n"
+	AuthFailedMessage    = "* Authentication failed: %s\n"
+	SlowDownMessage      = "* Slow down, message dropped\n"
+	MutedMessage         = "* You are muted for %s for flooding\n"
+	StillMutedMessage    = "* You are muted, message dropped\n"
+	KickedMessage        = "* Kicked for flooding\n"
+	TooManyConnections   = "* Too many connections from your address\n"
+	KickedByAdminMessage = "* Kicked by an admin: %s\n"
+	BannedMessage        = "* You are banned\n"
+	AnnouncementMessage  = "* Announcement: %s\n"
+	HelpMessage          = "* Commands: /msg <user> <text>, /who, /me <action>, /nick <newname>, /help\n"
 )
 
+// Usernames consist entirely of alphanumeric characters
+func isUsernameChar(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsDigit(r)
+}
+
+// Checks a username against the same rules ReadUsername enforces
+func ValidateUsername(name string) error {
+	if len(name) < MinUnameLength {
+		return errors.New("username too short")
+	}
+	if len(name) >= MaxUnameLength {
+		return errors.New("username too long")
+	}
+	if !utf8.ValidString(name) {
+		return errors.New("username not valid UTF-8")
+	}
+	for _, r := range name {
+		if !isUsernameChar(r) {
+			return errors.New("username character not alphanumeric")
+		}
+	}
+	return nil
+}
+
 func ReadUsername(conn net.Conn, buf *[]byte) error {
 	oneByteBuf := make([]byte, 1)
 	for i := 0; i < MaxUnameLength; i++ {
@@ -31,11 +97,12 @@ func ReadUsername(conn net.Conn, buf *[]byte) error {
 
 		// Newline terminates username
 		if oneByteBuf[0] == '\n' {
-			return nil
+			return ValidateUsername(string(*buf))
 		}
 
-		// Making sure character is alphanumeric
-		if !(unicode.IsLetter(rune(oneByteBuf[0])) || unicode.IsDigit(rune(oneByteBuf[0]))) {
+		// Making sure character is alphanumeric, characters longer than
+		// one byte can only be checked once the name is complete
+		if oneByteBuf[0] < utf8.RuneSelf && !isUsernameChar(rune(oneByteBuf[0])) {
 			return errors.New("username character not alphanumeric")
 		}
 
@@ -66,6 +133,18 @@ func ReadMessage(conn net.Conn, buf *[]byte) error {
 
 func handleIncomingConnection(conn net.Conn, chatRoom *ChatRoom) {
 	defer conn.Close()
+	if !chatRoom.connections.Acquire(conn.RemoteAddr()) {
+		log.Println("Too many connections from ", conn.RemoteAddr())
+		conn.Write([]byte(TooManyConnections))
+		return
+	}
+	defer chatRoom.connections.Release(conn.RemoteAddr())
+	if chatRoom.bans.AddrBanned(conn.RemoteAddr()) {
+		log.Println("Banned address ", conn.RemoteAddr())
+		conn.Write([]byte(BannedMessage))
+		return
+	}
+
 	// Send them a welcoming Message
 	conn.Write([]byte(WelcomeMessage))
 
@@ -74,49 +153,184 @@ func handleIncomingConnection(conn net.Conn, chatRoom *ChatRoom) {
 	err := ReadUsername(conn, &username)
 	if err != nil {
 		// Send error message to user
-		conn.Write([]byte(err.Error()))
+		fmt.Fprintf(conn, NameRejectedMessage, err)
 		return
 	}
 
-	// Finally add User to chatRoom (after stripping away whitespace)
-	// Make sure "username" is not after this, else potential vuln
-	user := User{
-		name:     []byte(strings.TrimSpace(string(username))),
-		receiver: make(chan string),
-		sender:   make(chan string),
-		chatRoom: chatRoom,
-		exit:     make(chan bool),
+	// Stripping away whitespace and applying the room's policies
+	// Make sure "username" is not used after this, else potential vuln
+	name, err := chatRoom.CheckUsername(strings.TrimSpace(string(username)))
+	if err != nil {
+		fmt.Fprintf(conn, NameRejectedMessage, err)
+		return
+	}
+	if err := chatRoom.Authenticate(conn, name); err != nil {
+		log.Printf("Authentication of %s failed: %v", name, err)
+		fmt.Fprintf(conn, AuthFailedMessage, err)
+		return
 	}
 
-	go user.StartSendHandler(conn)
-	go user.StartReceiveHandler(conn)
-	go user.CheckConnectionDead(conn)
-
-	err = chatRoom.AddUser(&user)
+	// Finally add User to chatRoom
+	user := NewUser(name, chatRoom)
+	user.addr = conn.RemoteAddr()
+	err = chatRoom.AddUser(user)
 	if err != nil {
 		log.Println("Error while adding user: ", err.Error())
+		fmt.Fprintf(conn, NameRejectedMessage, err)
 		return
 	}
 
+	// Whichever handler stops first cancels the other one
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		defer cancel()
+		user.StartSendHandler(ctx, conn)
+	}()
+	go func() {
+		defer wg.Done()
+		defer cancel()
+		user.StartReceiveHandler(ctx, conn)
+	}()
+
+	// Closing the connection unblocks a handler that is stuck in Read or Write
+	<-ctx.Done()
+	conn.Close()
+	wg.Wait()
+
+	log.Println("Leaving: ", user.Name())
+	chatRoom.UserLeave(user)
+}
+
+// Accepts connections until the listener fails
+func Serve(listen net.Listener, chatRoom *ChatRoom) error {
 	for {
-		<-user.exit
-		log.Println("Leaving: ", string(user.name))
-		user.exit <- true
-		chatRoom.UserLeave(&user)
-		return
-	}
+		conn, err := listen.Accept()
+		if err != nil {
+			return err
+		}
+		log.Println("Got Connection")
 
+		go handleIncomingConnection(conn, chatRoom)
+	}
 }
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "export" {
+		if err := runExport(os.Args[2:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	queueSize := flag.Int("queue-size", DefaultQueueSize, "amount of messages that may wait for a slow user")
+	overflow := flag.String("overflow", "drop-oldest", "what to do with a full user queue: drop-oldest or disconnect")
+	historySize := flag.Int("history", DefaultHistorySize, "amount of messages replayed to new users, 0 disables history")
+	historyFile := flag.String("history-file", "", "file to keep the history in across restarts")
+	transcriptDir := flag.String("transcript-dir", "", "directory to write a daily transcript of the room to, see the export subcommand")
+	roomName := flag.String("room-name", DefaultRoomName, "name of the room in transcript file names")
+	webSocketAddr := flag.String("ws-addr", "", "also serve the chat to browsers over WebSocket on this address, e.g. :8080")
+	ircAddr := flag.String("irc-addr", "", "also serve the chat to IRC clients on this address, e.g. :6667")
+	adminAddr := flag.String("admin-addr", "", "serve the admin console on this loopback address or unix:/path/to/socket")
+	reservedNames := flag.String("reserved-names", "", "comma separated names nobody may use")
+	profanityFile := flag.String("profanity-file", "", "file with one word per line that may not appear in names")
+	caseInsensitive := flag.Bool("case-insensitive-names", false, "treat names that only differ in case as the same name")
+	passwordFile := flag.String("passwd", "", "htpasswd style file (bcrypt, or legacy {SHA}/{SSHA} hashes) with passwords of registered users")
+	requireAuth := flag.Bool("require-auth", false, "only let users from the password file in")
+	messageRate := flag.Float64("rate", DefaultMessageRate, "messages per second a user may send on average, 0 disables rate limiting")
+	messageBurst := flag.Int("burst", DefaultMessageBurst, "messages a user may send at once before -rate applies")
+	floodStrikes := flag.Int("flood-strikes", DefaultFloodStrikes, "messages dropped for flooding before a user gets muted, 0 never mutes")
+	muteDuration := flag.Duration("mute", DefaultMuteDuration, "how long flooding users stay muted")
+	kickAfterMutes := flag.Int("kick-after-mutes", DefaultKickAfterMutes, "mutes before a flooding user gets kicked, 0 never kicks")
+	maxConnsPerIP := flag.Int("max-conns-per-ip", DefaultMaxConnectionsPerIP, "connections one IP may have open at once, 0 is unlimited")
+	hashPassword := flag.Bool("hash-password", false, "read a password from stdin, print its bcrypt hash for the -passwd file and exit")
+	tlsOptions := tlsutil.RegisterFlags()
+	flag.Parse()
 
-	chatRoom := ChatRoom{
-		amountUsers: 0,
-		sendMessage: make(chan Message),
+	if *hashPassword {
+		password, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil && password == "" {
+			log.Fatal(err)
+		}
+		hash, err := NewPasswordHash(strings.TrimRight(password, "\r\n"))
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Println(hash)
+		return
+	}
+
+	tlsConfig, err := tlsOptions.ServerConfig()
+	if err != nil {
+		log.Fatal(err)
 	}
-	go chatRoom.HandleMessageSpreading()
 
-	listen, err := net.Listen(Type, Host+":"+Port)
+	config := DefaultRoomConfig()
+	config.QueueSize = *queueSize
+	policy, err := ParseOverflowPolicy(*overflow)
+	if err != nil {
+		log.Fatal(err)
+	}
+	config.OverflowPolicy = policy
+	if *historySize < 0 {
+		log.Fatal("-history can't be negative")
+	}
+	config.HistorySize = *historySize
+	config.CaseInsensitiveNames = *caseInsensitive
+	config.RequireAuth = *requireAuth
+	config.MessageRate = *messageRate
+	config.MessageBurst = *messageBurst
+	config.FloodStrikes = *floodStrikes
+	config.MuteDuration = *muteDuration
+	config.KickAfterMutes = *kickAfterMutes
+	config.MaxConnectionsPerIP = *maxConnsPerIP
+
+	policies := PolicyChain{NormalizeUnicode()}
+	if *reservedNames != "" {
+		policies = append(policies, ReservedNames(strings.Split(*reservedNames, ",")))
+	}
+	if *profanityFile != "" {
+		words, err := LoadWordList(*profanityFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		policies = append(policies, ProfanityFilter(words))
+	}
+	config.UsernamePolicy = policies
+
+	if *passwordFile != "" {
+		config.Passwords, err = LoadPasswordFile(*passwordFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+	} else if *requireAuth {
+		log.Fatal("-require-auth needs a -passwd file")
+	}
+
+	chatRoom := NewChatRoom(config)
+	if *historyFile != "" {
+		history, err := LoadHistory(*historyFile, config.HistorySize)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer history.Close()
+		chatRoom.history = history
+	}
+	if *transcriptDir != "" {
+		transcript, err := OpenTranscript(*transcriptDir, *roomName)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer transcript.Close()
+		chatRoom.transcript = transcript
+	}
+	go chatRoom.Run()
+
+	listen, err := tlsutil.Listen(Type, Host+":"+Port, tlsConfig)
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -124,13 +338,41 @@ func main() {
 
 	log.Printf("Started serving on %s:%s\n", Host, Port)
 
-	for {
-		conn, err := listen.Accept()
-		log.Println("Got Connection")
+	if *webSocketAddr != "" {
+		webSocketListen, err := tlsutil.Listen(Type, *webSocketAddr, tlsConfig)
 		if err != nil {
 			log.Fatal(err)
 		}
+		defer webSocketListen.Close()
+		log.Printf("Started serving WebSocket on %s\n", *webSocketAddr)
+		go func() {
+			log.Fatal(http.Serve(webSocketListen, NewWebSocketHandler(chatRoom)))
+		}()
+	}
 
-		go handleIncomingConnection(conn, &chatRoom)
+	if *ircAddr != "" {
+		ircListen, err := tlsutil.Listen(Type, *ircAddr, tlsConfig)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer ircListen.Close()
+		log.Printf("Started serving IRC on %s\n", *ircAddr)
+		go func() {
+			log.Fatal(ServeIRC(ircListen, chatRoom))
+		}()
 	}
+
+	if *adminAddr != "" {
+		adminListen, err := ListenAdmin(*adminAddr)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer adminListen.Close()
+		log.Printf("Started serving admin console on %s\n", *adminAddr)
+		go func() {
+			log.Fatal(ServeAdmin(adminListen, chatRoom))
+		}()
+	}
+
+	log.Fatal(Serve(listen, chatRoom))
 }
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Starts a chat room served on a random local port
+func startTestServer(t *testing.T, config RoomConfig) (string, *ChatRoom) {
+	chatRoom := NewChatRoom(config)
+	go chatRoom.Run()
+
+	listen, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listen.Close() })
+	go Serve(listen, chatRoom)
+
+	return listen.Addr().String(), chatRoom
+}
+
+// Connects and joins the chat room as name, returns the user list line
+func joinTestClient(t *testing.T, addr string, name string) (net.Conn, *bufio.Reader, string) {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	reader := bufio.NewReader(conn)
+
+	welcome, err := reader.ReadString('\n')
+	if err != nil || welcome != WelcomeMessage {
+		t.Fatalf("expected welcome message, got %q (%v)", welcome, err)
+	}
+	fmt.Fprintf(conn, "%s\n", name)
+
+	userList, err := reader.ReadString('\n')
+	if err != nil {
+		t.Fatalf("expected user list, got %v", err)
+	}
+	return conn, reader, userList
+}
+
+func TestJoinChatAndLeave(t *testing.T) {
+	addr, _ := startTestServer(t, DefaultRoomConfig())
+
+	alice, aliceReader, userList := joinTestClient(t, addr, "alice")
+	defer alice.Close()
+	if userList != "* Users in Room: \n" {
+		t.Errorf("unexpected user list: %q", userList)
+	}
+
+	bob, _, userList := joinTestClient(t, addr, "bob")
+	if userList != "* Users in Room: alice\n" {
+		t.Errorf("unexpected user list: %q", userList)
+	}
+
+	expectLine(t, aliceReader, "* bob joined this chat room\n")
+	fmt.Fprint(bob, "hi alice\n")
+	expectLine(t, aliceReader, "[bob] hi alice\n")
+
+	bob.Close()
+	expectLine(t, aliceReader, "* bob left the chat room\n")
+}
+
+func expectLine(t *testing.T, reader *bufio.Reader, expected string) {
+	t.Helper()
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		t.Fatalf("expected %q, got error %v", expected, err)
+	}
+	if line != expected {
+		t.Fatalf("expected %q, got %q", expected, line)
+	}
+}
+
+// After a lot of users came and went, every goroutine they started has to be gone
+func TestNoGoroutineLeak(t *testing.T) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	addr, chatRoom := startTestServer(t, DefaultRoomConfig())
+	baseline := runtime.NumGoroutine()
+
+	for i := 0; i < 1000; i++ {
+		conn, _, _ := joinTestClient(t, addr, fmt.Sprintf("user%d", i))
+		switch i % 3 {
+		case 0:
+			// Say goodbye politely
+			fmt.Fprint(conn, "exit\n")
+		case 1:
+			// Leave in the middle of a message
+			fmt.Fprint(conn, "half a mess")
+		}
+		conn.Close()
+	}
+
+	deadline := time.Now().Add(10 * time.Second)
+	for runtime.NumGoroutine() > baseline || chatRoom.AmountUsers() != 0 {
+		if time.Now().After(deadline) {
+			buf := make([]byte, 1<<20)
+			n := runtime.Stack(buf, true)
+			t.Fatalf("%d goroutines left (baseline %d), %d users in room\n%s",
+				runtime.NumGoroutine(), baseline, chatRoom.AmountUsers(),
+				strings.TrimSpace(string(buf[:n])))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// alice stops reading while the room keeps talking. Once her writes block,
+// giving up on her has to get through the write she's stuck in.
+func TestStalledClientGetsDropped(t *testing.T) {
+	type test struct {
+		Name   string
+		Policy OverflowPolicy
+		// Dropping messages never gives up on her by itself, an admin has to
+		Kick bool
+	}
+	testCases := []test{
+		{Name: "disconnect slow consumer", Policy: DisconnectSlowConsumer},
+		{Name: "kicked", Policy: DropOldest, Kick: true},
+	}
+
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	for _, tc := range testCases {
+		config := DefaultRoomConfig()
+		config.QueueSize = 4
+		config.OverflowPolicy = tc.Policy
+		chatRoom := NewChatRoom(config)
+		go chatRoom.Run()
+
+		// Pipes don't buffer anything, writes wait until she reads
+		alice, server := net.Pipe()
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			handleIncomingConnection(server, chatRoom)
+		}()
+		alice.SetDeadline(time.Now().Add(5 * time.Second))
+		reader := bufio.NewReader(alice)
+		expectLine(t, reader, WelcomeMessage)
+		fmt.Fprint(alice, "alice\n")
+		expectLine(t, reader, "* Users in Room: \n")
+
+		carol, stopCarol := newTestUser("carol", chatRoom)
+		if err := chatRoom.AddUser(carol); err != nil {
+			t.Fatal(err)
+		}
+		// Taking a single byte of the join notice leaves her writer stuck on
+		// the rest of it
+		if _, err := alice.Read(make([]byte, 1)); err != nil {
+			t.Fatal(err)
+		}
+		// Her writer may be holding a whole queue's worth already
+		for i := 0; i < 3*config.QueueSize; i++ {
+			chatRoom.sendMessage <- Message{sender: carol, senderName: "carol", message: "anyone there?\n"}
+		}
+		if tc.Kick {
+			chatRoom.Kick("alice", "not listening")
+		}
+
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%s: alice never got dropped", tc.Name)
+		}
+		if chatRoom.AmountUsers() != 1 {
+			t.Errorf("%s: expected only carol left, got %d users", tc.Name, chatRoom.AmountUsers())
+		}
+		stopCarol()
+		alice.Close()
+	}
+}
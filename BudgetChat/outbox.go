@@ -0,0 +1,138 @@
+package main
+
+import (
+	"errors"
+	"sync"
+)
+
+// What happens when a user's outbox is full
+type OverflowPolicy int
+
+const (
+	// Throw away the oldest queued message to make room for the new one
+	DropOldest OverflowPolicy = iota
+	// Give up on the user, the connection gets closed
+	DisconnectSlowConsumer
+)
+
+func ParseOverflowPolicy(s string) (OverflowPolicy, error) {
+	switch s {
+	case "drop-oldest":
+		return DropOldest, nil
+	case "disconnect":
+		return DisconnectSlowConsumer, nil
+	}
+	return 0, errors.New("unknown overflow policy (want drop-oldest or disconnect)")
+}
+
+// Bounded queue of messages waiting to be written to one user.
+// Push never blocks, so a stalled client can't hold up the chat room.
+type Outbox struct {
+	mu       sync.Mutex
+	queue    []Message
+	capacity int
+	policy   OverflowPolicy
+	dropped  int
+
+	// Gets a value whenever the queue goes from empty to non-empty
+	ready chan struct{}
+	// Gets closed once the outbox gave up on its consumer
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func NewOutbox(capacity int, policy OverflowPolicy) *Outbox {
+	if capacity < 1 {
+		capacity = 1
+	}
+	return &Outbox{
+		capacity: capacity,
+		policy:   policy,
+		ready:    make(chan struct{}, 1),
+		closed:   make(chan struct{}),
+	}
+}
+
+// Queues msg for delivery, returns false if the outbox is closed
+func (o *Outbox) Push(msg Message) bool {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	select {
+	case <-o.closed:
+		return false
+	default:
+	}
+
+	if len(o.queue) >= o.capacity {
+		switch o.policy {
+		case DropOldest:
+			o.queue = o.queue[1:]
+			o.dropped++
+		case DisconnectSlowConsumer:
+			// No point in trying to deliver the backlog to someone that slow
+			o.queue = nil
+			o.close()
+			return false
+		}
+	}
+
+	o.queue = append(o.queue, msg)
+	select {
+	case o.ready <- struct{}{}:
+	default:
+	}
+	return true
+}
+
+// Takes every queued message out of the outbox
+func (o *Outbox) Drain() []Message {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	msgs := o.queue
+	o.queue = nil
+	return msgs
+}
+
+// Amount of messages thrown away because of DropOldest
+func (o *Outbox) Dropped() int {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.dropped
+}
+
+func (o *Outbox) Ready() <-chan struct{} {
+	return o.ready
+}
+
+func (o *Outbox) Closed() <-chan struct{} {
+	return o.closed
+}
+
+func (o *Outbox) Close() {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.close()
+}
+
+// Closes the outbox with msg as the last thing still delivered, anything
+// else waiting is thrown away
+func (o *Outbox) Kick(msg Message) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	select {
+	case <-o.closed:
+		return
+	default:
+	}
+	o.queue = []Message{msg}
+	o.close()
+}
+
+func (o *Outbox) close() {
+	o.closeOnce.Do(func() {
+		close(o.closed)
+	})
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestOutboxDropOldest(t *testing.T) {
+	outbox := NewOutbox(3, DropOldest)
+	for i := 0; i < 5; i++ {
+		if !outbox.Push(Message{senderName: "alice", message: fmt.Sprint(i)}) {
+			t.Fatal("DropOldest outbox should never refuse a message")
+		}
+	}
+
+	msgs := outbox.Drain()
+	if len(msgs) != 3 {
+		t.Fatalf("expected 3 queued messages, got %d", len(msgs))
+	}
+	for i, msg := range msgs {
+		if msg.message != fmt.Sprint(i+2) {
+			t.Errorf("expected message %d, got %s", i+2, msg.message)
+		}
+	}
+	if outbox.Dropped() != 2 {
+		t.Errorf("expected 2 dropped messages, got %d", outbox.Dropped())
+	}
+}
+
+func TestOutboxDisconnectSlowConsumer(t *testing.T) {
+	outbox := NewOutbox(2, DisconnectSlowConsumer)
+	outbox.Push(Message{message: "1"})
+	outbox.Push(Message{message: "2"})
+
+	if outbox.Push(Message{message: "3"}) {
+		t.Error("Pushing into a full outbox should fail")
+	}
+	select {
+	case <-outbox.Closed():
+	default:
+		t.Error("Outbox should be closed after overflowing")
+	}
+	if outbox.Push(Message{message: "4"}) {
+		t.Error("Pushing into a closed outbox should fail")
+	}
+}
+
+// Nobody ever reads alice's outbox, bob still has to get every message
+// without waiting on her
+func TestStalledReaderDoesNotDelayOthers(t *testing.T) {
+	for _, policy := range []OverflowPolicy{DropOldest, DisconnectSlowConsumer} {
+		config := DefaultRoomConfig()
+		config.QueueSize = 4
+		config.OverflowPolicy = policy
+
+		chatRoom := NewChatRoom(config)
+		go chatRoom.Run()
+
+		alice := NewUser("alice", chatRoom)
+		bob := NewUser("bob", chatRoom)
+		carol, stopCarol := newTestUser("carol", chatRoom)
+		for _, u := range []*User{alice, bob, carol} {
+			if err := chatRoom.AddUser(u); err != nil {
+				t.Fatal(err)
+			}
+		}
+		<-bob.outbox.Ready()
+		bob.outbox.Drain()
+
+		// Each message has to reach bob before the next one is sent, while
+		// alice's queue overflows over and over
+		for i := 0; i < 100; i++ {
+			chatRoom.sendMessage <- Message{senderName: "carol", message: fmt.Sprintf("%d\n", i)}
+			select {
+			case <-bob.outbox.Ready():
+				msgs := bob.outbox.Drain()
+				if len(msgs) != 1 || msgs[0].message != fmt.Sprintf("%d\n", i) {
+					t.Fatalf("bob expected message %d, got %v", i, msgs)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("bob got stuck behind alice")
+			}
+		}
+
+		if policy == DisconnectSlowConsumer {
+			select {
+			case <-alice.outbox.Closed():
+			default:
+				t.Error("alice should have been disconnected")
+			}
+		}
+		stopCarol()
+	}
+}
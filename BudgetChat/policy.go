@@ -0,0 +1,97 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"os"
+	"strings"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// Decides whether someone may call themselves name. Returns the name they
+// will actually get (policies may normalize it) or why it was rejected.
+type UsernamePolicy interface {
+	Check(name string) (string, error)
+}
+
+type UsernamePolicyFunc func(name string) (string, error)
+
+func (f UsernamePolicyFunc) Check(name string) (string, error) {
+	return f(name)
+}
+
+// Runs every policy in order, each one sees the name the last one returned
+type PolicyChain []UsernamePolicy
+
+func (chain PolicyChain) Check(name string) (string, error) {
+	for _, policy := range chain {
+		var err error
+		name, err = policy.Check(name)
+		if err != nil {
+			return "", err
+		}
+	}
+	return name, nil
+}
+
+// Brings names into Unicode normalization form KC, so names that look the
+// same are the same. The result has to pass ValidateUsername again.
+func NormalizeUnicode() UsernamePolicy {
+	return UsernamePolicyFunc(func(name string) (string, error) {
+		name = norm.NFKC.String(name)
+		return name, ValidateUsername(name)
+	})
+}
+
+// Names nobody may use, compared case-insensitively
+func ReservedNames(names []string) UsernamePolicy {
+	reserved := make(map[string]bool)
+	for _, name := range names {
+		reserved[strings.ToLower(name)] = true
+	}
+	return UsernamePolicyFunc(func(name string) (string, error) {
+		if reserved[strings.ToLower(name)] {
+			return "", errors.New("username is reserved")
+		}
+		return name, nil
+	})
+}
+
+// Rejects names containing any of words, compared case-insensitively
+func ProfanityFilter(words []string) UsernamePolicy {
+	var lowerWords []string
+	for _, word := range words {
+		if word != "" {
+			lowerWords = append(lowerWords, strings.ToLower(word))
+		}
+	}
+	return UsernamePolicyFunc(func(name string) (string, error) {
+		lowerName := strings.ToLower(name)
+		for _, word := range lowerWords {
+			if strings.Contains(lowerName, word) {
+				return "", errors.New("username is not allowed")
+			}
+		}
+		return name, nil
+	})
+}
+
+// Reads one word per line, empty lines and lines starting with # are skipped
+func LoadWordList(path string) ([]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var words []string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		word := strings.TrimSpace(scanner.Text())
+		if word != "" && !strings.HasPrefix(word, "#") {
+			words = append(words, word)
+		}
+	}
+	return words, scanner.Err()
+}
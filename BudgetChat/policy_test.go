@@ -0,0 +1,100 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestUsernamePolicies(t *testing.T) {
+	type test struct {
+		Name     string
+		Expected string
+		Error    bool
+	}
+
+	policy := PolicyChain{
+		NormalizeUnicode(),
+		ReservedNames([]string{"admin", "Server"}),
+		ProfanityFilter([]string{"darn"}),
+	}
+	testCases := []test{
+		{Name: "alice", Expected: "alice"},
+		{Name: "zoë", Expected: "zoë"},
+		// Fullwidth letters look like ASCII and normalize to it
+		{Name: "ａｌｉｃｅ", Expected: "alice"},
+		// e followed by a combining diaeresis is the same as ë
+		{Name: "zoë", Expected: "zoë"},
+		{Name: "ADMIN", Error: true},
+		{Name: "server", Error: true},
+		{Name: "ｓｅｒｖｅｒ", Error: true},
+		{Name: "DarnIt", Error: true},
+		// Normalizing may not sneak in characters that aren't allowed
+		{Name: "a․b", Error: true},
+	}
+
+	for _, tc := range testCases {
+		name, err := policy.Check(tc.Name)
+		if tc.Error {
+			if err == nil {
+				t.Errorf("Name: %q, expected rejection, got %q", tc.Name, name)
+			}
+			continue
+		}
+		if err != nil || name != tc.Expected {
+			t.Errorf("Name: %q, expected: %q, got: %q (%v)", tc.Name, tc.Expected, name, err)
+		}
+	}
+}
+
+func TestValidateUsername(t *testing.T) {
+	valid := []string{"alice", "Bob42", "zoë", "日本"}
+	invalid := []string{"", "al ice", "bob!", "\xff\xfe", string(make([]byte, MaxUnameLength))}
+
+	for _, name := range valid {
+		if err := ValidateUsername(name); err != nil {
+			t.Errorf("%q should be valid: %v", name, err)
+		}
+	}
+	for _, name := range invalid {
+		if err := ValidateUsername(name); err == nil {
+			t.Errorf("%q should be invalid", name)
+		}
+	}
+}
+
+func TestNameRejections(t *testing.T) {
+	config := DefaultRoomConfig()
+	config.CaseInsensitiveNames = true
+	config.UsernamePolicy = PolicyChain{NormalizeUnicode(), ReservedNames([]string{"admin"})}
+	addr, _ := startTestServer(t, config)
+
+	alice, aliceReader, _ := joinTestClient(t, addr, "alice")
+	defer alice.Close()
+
+	type test struct {
+		Name     string
+		Response string
+	}
+	testCases := []test{
+		{Name: "ALICE", Response: "* Name rejected: username already exists in chat room\n"},
+		{Name: "ａｌｉｃｅ", Response: "* Name rejected: username already exists in chat room\n"},
+		{Name: "Admin", Response: "* Name rejected: username is reserved\n"},
+		{Name: "bob!", Response: "* Name rejected: username character not alphanumeric\n"},
+		{Name: "", Response: "* Name rejected: username too short\n"},
+	}
+	for _, tc := range testCases {
+		conn, _, response := joinTestClient(t, addr, tc.Name)
+		conn.Close()
+		if response != tc.Response {
+			t.Errorf("Name: %q, expected: %q, got: %q", tc.Name, tc.Response, response)
+		}
+	}
+
+	// Renaming goes through the same policies
+	fmt.Fprint(alice, "/nick admin\n")
+	expectLine(t, aliceReader, "* Error: username is reserved\n")
+	bob, bobReader, _ := joinTestClient(t, addr, "zoë")
+	defer bob.Close()
+	fmt.Fprint(bob, "/nick Alice\n")
+	expectLine(t, bobReader, "* Error: username already exists in chat room\n")
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+// Classic token bucket: holds up to burst tokens, refills at rate tokens
+// per second and every message takes one
+type TokenBucket struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// A rate of 0 or less lets everything through
+func NewTokenBucket(rate float64, burst int) *TokenBucket {
+	if burst < 1 {
+		burst = 1
+	}
+	return &TokenBucket{rate: rate, burst: float64(burst), tokens: float64(burst)}
+}
+
+// Takes a token if there is one. now is passed in so tests don't have to sleep.
+func (b *TokenBucket) Allow(now time.Time) bool {
+	if b.rate <= 0 {
+		return true
+	}
+	if !b.last.IsZero() && now.After(b.last) {
+		b.tokens += now.Sub(b.last).Seconds() * b.rate
+		if b.tokens > b.burst {
+			b.tokens = b.burst
+		}
+	}
+	b.last = now
+
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// How much one user has been flooding the room
+type floodGuard struct {
+	mu         sync.Mutex
+	bucket     *TokenBucket
+	strikes    int
+	mutes      int
+	mutedUntil time.Time
+}
+
+// Decides whether user may send another message right now. Flooding first
+// gets messages dropped, then the user muted and at last kicked. The user
+// gets told about every step, nobody else notices.
+func (user *User) allowMessage() bool {
+	config := user.chatRoom.config
+	guard := &user.flood
+	guard.mu.Lock()
+	defer guard.mu.Unlock()
+
+	now := time.Now()
+	if now.Before(guard.mutedUntil) {
+		user.outbox.Push(notice(StillMutedMessage))
+		return false
+	}
+	if guard.bucket.Allow(now) {
+		return true
+	}
+
+	guard.strikes++
+	if config.FloodStrikes <= 0 || guard.strikes < config.FloodStrikes {
+		user.outbox.Push(notice(SlowDownMessage))
+		return false
+	}
+
+	guard.strikes = 0
+	guard.mutes++
+	if config.KickAfterMutes > 0 && guard.mutes >= config.KickAfterMutes {
+		log.Printf("Kicking %s for flooding", user.Name())
+		user.outbox.Kick(notice(KickedMessage))
+		return false
+	}
+	log.Printf("Muting %s for flooding", user.Name())
+	guard.mutedUntil = now.Add(config.MuteDuration)
+	user.outbox.Push(notice(fmt.Sprintf(MutedMessage, config.MuteDuration)))
+	return false
+}
+
+func notice(text string) Message {
+	return Message{kind: SystemMessage, message: text}
+}
+
+// Counts open connections per remote IP, so one host can't take up every
+// name or file descriptor
+type ConnectionLimiter struct {
+	mu    sync.Mutex
+	max   int
+	count map[string]int
+}
+
+// A max of 0 or less allows any amount of connections
+func NewConnectionLimiter(max int) *ConnectionLimiter {
+	return &ConnectionLimiter{max: max, count: make(map[string]int)}
+}
+
+// Registers a connection from addr, returns false if its IP already has the
+// maximum amount of connections open. Every successful Acquire needs a
+// Release once the connection is gone.
+func (l *ConnectionLimiter) Acquire(addr net.Addr) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	ip := remoteIP(addr)
+	if l.max > 0 && l.count[ip] >= l.max {
+		return false
+	}
+	l.count[ip]++
+	return true
+}
+
+func (l *ConnectionLimiter) Release(addr net.Addr) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	ip := remoteIP(addr)
+	l.count[ip]--
+	if l.count[ip] <= 0 {
+		delete(l.count, ip)
+	}
+}
+
+// Amount of connections open right now
+func (l *ConnectionLimiter) Open() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	open := 0
+	for _, count := range l.count {
+		open += count
+	}
+	return open
+}
+
+func remoteIP(addr net.Addr) string {
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return host
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestTokenBucket(t *testing.T) {
+	type test struct {
+		// Time since the start
+		At       time.Duration
+		Expected bool
+	}
+
+	// 2 messages per second, 3 at once
+	bucket := NewTokenBucket(2, 3)
+	testCases := []test{
+		{At: 0, Expected: true},
+		{At: 0, Expected: true},
+		{At: 0, Expected: true},
+		{At: 0, Expected: false},
+		{At: 100 * time.Millisecond, Expected: false},
+		// Half a second refills one token
+		{At: 500 * time.Millisecond, Expected: true},
+		{At: 500 * time.Millisecond, Expected: false},
+		// A long break never refills more than the burst
+		{At: time.Hour, Expected: true},
+		{At: time.Hour, Expected: true},
+		{At: time.Hour, Expected: true},
+		{At: time.Hour, Expected: false},
+	}
+
+	start := time.Now()
+	for i, tc := range testCases {
+		if got := bucket.Allow(start.Add(tc.At)); got != tc.Expected {
+			t.Errorf("Case %d at %s: expected: %v, got: %v", i, tc.At, tc.Expected, got)
+		}
+	}
+
+	unlimited := NewTokenBucket(0, 0)
+	for i := 0; i < 1000; i++ {
+		if !unlimited.Allow(start) {
+			t.Fatal("A rate of 0 should allow everything")
+		}
+	}
+}
+
+func TestConnectionLimiter(t *testing.T) {
+	limiter := NewConnectionLimiter(2)
+	first := &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 1}
+	second := &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 2}
+	third := &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 3}
+	other := &net.TCPAddr{IP: net.ParseIP("10.0.0.2"), Port: 1}
+
+	if !limiter.Acquire(first) || !limiter.Acquire(second) {
+		t.Fatal("Two connections should be allowed")
+	}
+	if limiter.Acquire(third) {
+		t.Error("The third connection from the same IP should be refused")
+	}
+	if !limiter.Acquire(other) {
+		t.Error("Other IPs have their own limit")
+	}
+	limiter.Release(first)
+	if !limiter.Acquire(third) {
+		t.Error("A released connection should make room for another")
+	}
+}
+
+func TestFloodingGetsMutedThenKicked(t *testing.T) {
+	config := DefaultRoomConfig()
+	config.MessageRate = 0.01
+	config.MessageBurst = 2
+	config.FloodStrikes = 2
+	config.MuteDuration = 200 * time.Millisecond
+	config.KickAfterMutes = 2
+	addr, _ := startTestServer(t, config)
+
+	bob, bobReader, _ := joinTestClient(t, addr, "bob")
+	defer bob.Close()
+	alice, aliceReader, _ := joinTestClient(t, addr, "alice")
+	defer alice.Close()
+	expectLine(t, bobReader, "* alice joined this chat room\n")
+
+	say := func(text string, response string) {
+		t.Helper()
+		fmt.Fprintf(alice, "%s\n", text)
+		if response != "" {
+			expectLine(t, aliceReader, response)
+		}
+	}
+	say("one", "")
+	say("two", "")
+	say("three", "* Slow down, message dropped\n")
+	say("four", "* You are muted for 200ms for flooding\n")
+	say("five", "* You are muted, message dropped\n")
+
+	// The mute is over, but the bucket is still empty
+	time.Sleep(250 * time.Millisecond)
+	say("six", "* Slow down, message dropped\n")
+	say("seven", "* Kicked for flooding\n")
+	if line, err := aliceReader.ReadString('\n'); err == nil {
+		t.Errorf("Connection should be closed after the kick, got %q", line)
+	}
+
+	// Nothing dropped made it to anyone else
+	expectLine(t, bobReader, "[alice] one\n")
+	expectLine(t, bobReader, "[alice] two\n")
+	expectLine(t, bobReader, "* alice left the chat room\n")
+}
+
+func TestMaxConnectionsPerIP(t *testing.T) {
+	config := DefaultRoomConfig()
+	config.MaxConnectionsPerIP = 2
+	addr, _ := startTestServer(t, config)
+
+	alice, _, _ := joinTestClient(t, addr, "alice")
+	defer alice.Close()
+	bob, _, _ := joinTestClient(t, addr, "bob")
+	defer bob.Close()
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	expectLine(t, bufio.NewReader(conn), "* Too many connections from your address\n")
+}
+
+// Without the flags nobody gets throttled, however chatty or however many
+// connections come from one address
+func TestLimitsOffByDefault(t *testing.T) {
+	addr, _ := startTestServer(t, DefaultRoomConfig())
+
+	alice, _, _ := joinTestClient(t, addr, "alice")
+	defer alice.Close()
+	bob, bobReader, _ := joinTestClient(t, addr, "bob")
+	defer bob.Close()
+	for i := 0; i < 20; i++ {
+		conn, _, _ := joinTestClient(t, addr, fmt.Sprintf("lurker%d", i))
+		defer conn.Close()
+		expectLine(t, bobReader, fmt.Sprintf("* lurker%d joined this chat room\n", i))
+	}
+
+	for i := 0; i < 100; i++ {
+		fmt.Fprintf(alice, "message %d\n", i)
+	}
+	for i := 0; i < 100; i++ {
+		expectLine(t, bobReader, fmt.Sprintf("[alice] message %d\n", i))
+	}
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"testing"
+	"time"
+
+	"lightstack.ml/tlsutil"
+)
+
+// The real server behind TLS, with client certificates required
+func TestBudgetChatOverTLS(t *testing.T) {
+	serverConfig, clientConfig, err := tlsutil.NewTestConfigs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	listen, err := tlsutil.Listen("tcp", "127.0.0.1:0", serverConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listen.Close()
+	chatRoom := NewChatRoom(DefaultRoomConfig())
+	go chatRoom.Run()
+	go Serve(listen, chatRoom)
+
+	conn, err := tls.Dial("tcp", listen.Addr().String(), clientConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	reader := bufio.NewReader(conn)
+	expectLine(t, reader, WelcomeMessage)
+	conn.Write([]byte("alice\n"))
+	expectLine(t, reader, "* Users in Room: \n")
+
+	// Trusts the server but has no certificate of its own
+	anonymous := clientConfig.Clone()
+	anonymous.Certificates = nil
+	rejected, err := tls.Dial("tcp", listen.Addr().String(), anonymous)
+	if err != nil {
+		return
+	}
+	defer rejected.Close()
+	rejected.SetDeadline(time.Now().Add(5 * time.Second))
+	// With TLS 1.3 the rejection only shows up once we read
+	rejected.Write([]byte("hello"))
+	if _, err := rejected.Read(make([]byte, 5)); err == nil {
+		t.Error("Server should not talk to clients without a certificate")
+	}
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"html/template"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Days start and end in UTC, so a transcript file never depends on where
+// the server happens to run
+const TranscriptDayFormat = "2006-01-02"
+
+// Everything said in a room, with one JSON Lines file of HistoryEntry per
+// day named <room>-2006-01-02.jsonl. Private messages are left out. Only
+// used from the room goroutine, a nil Transcript records nothing.
+type Transcript struct {
+	dir  string
+	room string
+	// Day the open file belongs to
+	day  string
+	file *os.File
+}
+
+func OpenTranscript(dir string, room string) (*Transcript, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &Transcript{dir: dir, room: room}, nil
+}
+
+func transcriptPath(dir string, room string, day string) string {
+	return filepath.Join(dir, fmt.Sprintf("%s-%s.jsonl", room, day))
+}
+
+func (t *Transcript) Record(msg Message) {
+	if t == nil {
+		return
+	}
+	entry := HistoryEntry{
+		Time:    time.Now(),
+		Kind:    msg.kind,
+		Sender:  msg.senderName,
+		Message: msg.message,
+	}
+	if err := t.add(entry); err != nil {
+		log.Println("Can't write transcript: ", err)
+	}
+}
+
+func (t *Transcript) add(entry HistoryEntry) error {
+	// Starting a new file once the day is over
+	day := entry.Time.UTC().Format(TranscriptDayFormat)
+	if day != t.day {
+		if err := t.Close(); err != nil {
+			log.Println("Can't close transcript: ", err)
+		}
+		file, err := os.OpenFile(transcriptPath(t.dir, t.room, day), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+		if err != nil {
+			return err
+		}
+		t.file = file
+		t.day = day
+	}
+	return writeHistoryEntry(t.file, entry)
+}
+
+func (t *Transcript) Close() error {
+	if t == nil || t.file == nil {
+		return nil
+	}
+	err := t.file.Close()
+	t.file = nil
+	t.day = ""
+	return err
+}
+
+// Returns every entry of room with from <= time < to, oldest first
+func ReadTranscript(dir string, room string, from time.Time, to time.Time) ([]HistoryEntry, error) {
+	var entries []HistoryEntry
+	lastDay := to.UTC().Format(TranscriptDayFormat)
+	for day := from.UTC(); day.Format(TranscriptDayFormat) <= lastDay; day = day.AddDate(0, 0, 1) {
+		file, err := os.Open(transcriptPath(dir, room, day.Format(TranscriptDayFormat)))
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		scanner := bufio.NewScanner(file)
+		// Long enough for any message, even with JSON escaping
+		scanner.Buffer(make([]byte, 0, 64*1024), 16*MaxMessageLength)
+		for scanner.Scan() {
+			var entry HistoryEntry
+			if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+				log.Println("Skipping broken transcript line: ", err)
+				continue
+			}
+			if !entry.Time.Before(from) && entry.Time.Before(to) {
+				entries = append(entries, entry)
+			}
+		}
+		file.Close()
+		if err := scanner.Err(); err != nil {
+			return nil, err
+		}
+	}
+	return entries, nil
+}
+
+var transcriptHTML = template.Must(template.New("transcript").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>{{.Room}} transcript</title>
+<style>
+body { font-family: monospace; }
+td { padding: 0 1em 0 0; vertical-align: top; }
+.time { color: #888; white-space: nowrap; }
+.server { color: #666; font-style: italic; }
+</style>
+</head>
+<body>
+<h1>{{.Room}}, {{.From}} to {{.To}}</h1>
+<table>
+{{- range .Lines}}
+<tr{{if .Server}} class="server"{{end}}><td class="time">{{.Time}}</td><td>{{.Text}}</td></tr>
+{{- end}}
+</table>
+</body>
+</html>
+`))
+
+// Writes entries to w as "text", "jsonl" or "html"
+func ExportTranscript(w io.Writer, room string, from time.Time, to time.Time, entries []HistoryEntry, format string) error {
+	switch format {
+	case "text":
+		for _, entry := range entries {
+			if _, err := fmt.Fprintf(w, "%s %s\n", entry.Time.UTC().Format(time.RFC3339), entryText(entry)); err != nil {
+				return err
+			}
+		}
+		return nil
+	case "jsonl":
+		encoder := json.NewEncoder(w)
+		for _, entry := range entries {
+			if err := encoder.Encode(entry); err != nil {
+				return err
+			}
+		}
+		return nil
+	case "html":
+		type line struct {
+			Time   string
+			Text   string
+			Server bool
+		}
+		page := struct {
+			Room     string
+			From, To string
+			Lines    []line
+		}{Room: room, From: from.UTC().Format(time.RFC3339), To: to.UTC().Format(time.RFC3339)}
+		for _, entry := range entries {
+			page.Lines = append(page.Lines, line{
+				Time:   entry.Time.UTC().Format("2006-01-02 15:04:05"),
+				Text:   entryText(entry),
+				Server: entry.Kind != ChatMessage,
+			})
+		}
+		return transcriptHTML.Execute(w, page)
+	}
+	return fmt.Errorf("unknown export format %q (want text, jsonl or html)", format)
+}
+
+// What the entry looked like in the chat, without the trailing newline
+func entryText(entry HistoryEntry) string {
+	msg := Message{kind: entry.Kind, senderName: entry.Sender, message: entry.Message}
+	return strings.TrimRight(msg.String(), "\r\n")
+}
+
+// Accepts RFC 3339 timestamps, "2006-01-02T15:04" and plain days, all
+// without a zone taken as UTC
+func parseExportTime(value string) (time.Time, error) {
+	for _, layout := range []string{time.RFC3339, "2006-01-02T15:04:05", "2006-01-02T15:04", TranscriptDayFormat} {
+		if t, err := time.Parse(layout, value); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("can't parse time %q, use e.g. 2006-01-02 or 2006-01-02T15:04", value)
+}
+
+// The "export" subcommand, e.g.
+// budgetChat export -transcript-dir logs -from 2022-10-01 -to 2022-10-02 -format html
+func runExport(args []string) error {
+	flags := flag.NewFlagSet("export", flag.ExitOnError)
+	dir := flags.String("transcript-dir", "transcripts", "directory the server writes transcripts to")
+	room := flags.String("room", DefaultRoomName, "room to export")
+	fromFlag := flags.String("from", "", "start of the time window, default 24 hours ago")
+	toFlag := flags.String("to", "", "end of the time window (exclusive), default now")
+	format := flags.String("format", "text", "output format: text, jsonl or html")
+	output := flags.String("o", "", "file to write to instead of stdout")
+	flags.Parse(args)
+
+	to := time.Now()
+	if *toFlag != "" {
+		var err error
+		if to, err = parseExportTime(*toFlag); err != nil {
+			return err
+		}
+	}
+	from := to.Add(-24 * time.Hour)
+	if *fromFlag != "" {
+		var err error
+		if from, err = parseExportTime(*fromFlag); err != nil {
+			return err
+		}
+	}
+	if !from.Before(to) {
+		return fmt.Errorf("-from has to be before -to")
+	}
+
+	entries, err := ReadTranscript(*dir, *room, from, to)
+	if err != nil {
+		return err
+	}
+
+	var w io.Writer = os.Stdout
+	if *output != "" {
+		file, err := os.Create(*output)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		w = file
+	}
+	return ExportTranscript(w, *room, from, to, entries, *format)
+}
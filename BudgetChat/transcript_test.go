@@ -0,0 +1,163 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testTranscriptTime(value string) time.Time {
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		panic(err)
+	}
+	return t
+}
+
+func TestTranscriptRotatesDaily(t *testing.T) {
+	dir := t.TempDir()
+	transcript, err := OpenTranscript(dir, "lobby")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer transcript.Close()
+
+	entries := []HistoryEntry{
+		{Time: testTranscriptTime("2022-10-01T23:58:00Z"), Kind: JoinMessage, Sender: "alice"},
+		{Time: testTranscriptTime("2022-10-01T23:59:00Z"), Kind: ChatMessage, Sender: "alice", Message: "still up?\n"},
+		// Same instant as above in UTC+2, it is a day later there but not in UTC
+		{Time: testTranscriptTime("2022-10-02T01:59:30+02:00"), Kind: ChatMessage, Sender: "alice", Message: "anyone?\n"},
+		{Time: testTranscriptTime("2022-10-02T00:01:00Z"), Kind: LeaveMessage, Sender: "alice"},
+	}
+	for _, entry := range entries {
+		if err := transcript.add(entry); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for day, expected := range map[string]int{"2022-10-01": 3, "2022-10-02": 1} {
+		content, err := os.ReadFile(filepath.Join(dir, "lobby-"+day+".jsonl"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if lines := strings.Count(string(content), "\n"); lines != expected {
+			t.Errorf("%s: expected %d lines, got %d", day, expected, lines)
+		}
+	}
+
+	type test struct {
+		From     string
+		To       string
+		Expected int
+	}
+	testCases := []test{
+		{From: "2022-10-01T00:00:00Z", To: "2022-10-03T00:00:00Z", Expected: 4},
+		{From: "2022-10-01T23:59:00Z", To: "2022-10-02T00:01:00Z", Expected: 2},
+		{From: "2022-10-02T00:00:00Z", To: "2022-10-02T12:00:00Z", Expected: 1},
+		{From: "2022-09-01T00:00:00Z", To: "2022-09-02T00:00:00Z", Expected: 0},
+	}
+	for _, tc := range testCases {
+		got, err := ReadTranscript(dir, "lobby", testTranscriptTime(tc.From), testTranscriptTime(tc.To))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(got) != tc.Expected {
+			t.Errorf("From: %s, To: %s, expected: %d entries, got: %d", tc.From, tc.To, tc.Expected, len(got))
+		}
+	}
+}
+
+func TestExportTranscript(t *testing.T) {
+	from := testTranscriptTime("2022-10-01T00:00:00Z")
+	to := testTranscriptTime("2022-10-02T00:00:00Z")
+	entries := []HistoryEntry{
+		{Time: testTranscriptTime("2022-10-01T12:00:00Z"), Kind: JoinMessage, Sender: "alice"},
+		{Time: testTranscriptTime("2022-10-01T12:00:05Z"), Kind: ChatMessage, Sender: "alice", Message: "<b>hi</b>\n"},
+		{Time: testTranscriptTime("2022-10-01T12:00:09Z"), Kind: ActionMessage, Sender: "alice", Message: "waves\n"},
+	}
+
+	var text bytes.Buffer
+	if err := ExportTranscript(&text, "lobby", from, to, entries, "text"); err != nil {
+		t.Fatal(err)
+	}
+	expected := "2022-10-01T12:00:00Z * alice joined this chat room\n" +
+		"2022-10-01T12:00:05Z [alice] <b>hi</b>\n" +
+		"2022-10-01T12:00:09Z * alice waves\n"
+	if text.String() != expected {
+		t.Errorf("expected text:\n%s\ngot:\n%s", expected, text.String())
+	}
+
+	var jsonl bytes.Buffer
+	if err := ExportTranscript(&jsonl, "lobby", from, to, entries, "jsonl"); err != nil {
+		t.Fatal(err)
+	}
+	for i, line := range strings.Split(strings.TrimSpace(jsonl.String()), "\n") {
+		var entry HistoryEntry
+		if err := json.Unmarshal([]byte(line), &entry); err != nil || entry != entries[i] {
+			t.Errorf("line %d: expected %+v, got %+v (%v)", i, entries[i], entry, err)
+		}
+	}
+
+	var html bytes.Buffer
+	if err := ExportTranscript(&html, "lobby", from, to, entries, "html"); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(html.String(), "<b>hi</b>") || !strings.Contains(html.String(), "&lt;b&gt;hi&lt;/b&gt;") {
+		t.Errorf("Messages should be escaped in HTML:\n%s", html.String())
+	}
+
+	if err := ExportTranscript(&html, "lobby", from, to, entries, "pdf"); err == nil {
+		t.Error("Unknown formats should be refused")
+	}
+}
+
+func TestRoomWritesTranscript(t *testing.T) {
+	dir := t.TempDir()
+	addr, chatRoom := startTestServer(t, DefaultRoomConfig())
+	transcript, err := OpenTranscript(dir, "lobby")
+	if err != nil {
+		t.Fatal(err)
+	}
+	chatRoom.do(func() { chatRoom.transcript = transcript })
+	defer transcript.Close()
+
+	alice, aliceReader, _ := joinTestClient(t, addr, "alice")
+	defer alice.Close()
+	bob, _, _ := joinTestClient(t, addr, "bob")
+	expectLine(t, aliceReader, "* bob joined this chat room\n")
+
+	fmt.Fprint(bob, "hi alice\n")
+	expectLine(t, aliceReader, "[bob] hi alice\n")
+	fmt.Fprint(bob, "/msg alice this stays private\n")
+	expectLine(t, aliceReader, "[bob -> you] this stays private\n")
+	fmt.Fprint(bob, "/me leaves\n")
+	expectLine(t, aliceReader, "* bob leaves\n")
+	bob.Close()
+	expectLine(t, aliceReader, "* bob left the chat room\n")
+
+	// Wait for the room to be done writing
+	chatRoom.UserNames()
+	entries, err := ReadTranscript(dir, "lobby", time.Now().Add(-time.Hour), time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var lines []string
+	for _, entry := range entries {
+		lines = append(lines, entryText(entry))
+	}
+	expected := []string{
+		"* alice joined this chat room",
+		"* bob joined this chat room",
+		"[bob] hi alice",
+		"* bob leaves",
+		"* bob left the chat room",
+	}
+	if strings.Join(lines, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("expected transcript:\n%s\ngot:\n%s", strings.Join(expected, "\n"), strings.Join(lines, "\n"))
+	}
+}
@@ -0,0 +1,305 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha1"
+	_ "embed"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Magic value every WebSocket server appends to the client's key (RFC 6455 1.3)
+const webSocketGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+const (
+	opContinuation = 0x0
+	opText         = 0x1
+	opBinary       = 0x2
+	opClose        = 0x8
+	opPing         = 0x9
+	opPong         = 0xA
+
+	closeNormal        = 1000
+	closeProtocolError = 1002
+	closeTooBig        = 1009
+)
+
+//go:embed client.html
+var webSocketClient []byte
+
+// Serves the browser client on "/" and lets it join chatRoom through "/ws"
+func NewWebSocketHandler(chatRoom *ChatRoom) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Write(webSocketClient)
+	})
+	mux.HandleFunc("/ws", func(w http.ResponseWriter, r *http.Request) {
+		conn, err := UpgradeWebSocket(w, r)
+		if err != nil {
+			log.Println("WebSocket upgrade failed: ", err)
+			return
+		}
+		log.Println("Got WebSocket Connection")
+		handleIncomingConnection(conn, chatRoom)
+	})
+	return mux
+}
+
+// Computes the Sec-WebSocket-Accept header for a Sec-WebSocket-Key
+func webSocketAccept(key string) string {
+	hash := sha1.Sum([]byte(key + webSocketGUID))
+	return base64.StdEncoding.EncodeToString(hash[:])
+}
+
+func headerContains(header http.Header, name string, value string) bool {
+	for _, v := range header.Values(name) {
+		for _, token := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(token), value) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Performs the opening handshake and takes over the connection. Every
+// text or binary message of the client reads as one line on the
+// returned conn, every Write goes out as one text message.
+func UpgradeWebSocket(w http.ResponseWriter, r *http.Request) (net.Conn, error) {
+	key := r.Header.Get("Sec-WebSocket-Key")
+	switch {
+	case r.Method != http.MethodGet:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return nil, errors.New("not a GET request")
+	case !headerContains(r.Header, "Connection", "upgrade") || !headerContains(r.Header, "Upgrade", "websocket"):
+		http.Error(w, "expected a websocket upgrade", http.StatusBadRequest)
+		return nil, errors.New("not a websocket upgrade")
+	case r.Header.Get("Sec-WebSocket-Version") != "13":
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		http.Error(w, "unsupported websocket version", http.StatusUpgradeRequired)
+		return nil, errors.New("unsupported websocket version")
+	case key == "":
+		http.Error(w, "missing Sec-WebSocket-Key", http.StatusBadRequest)
+		return nil, errors.New("missing Sec-WebSocket-Key")
+	}
+
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "can't take over connection", http.StatusInternalServerError)
+		return nil, errors.New("response writer can't be hijacked")
+	}
+	conn, rw, err := hijacker.Hijack()
+	if err != nil {
+		return nil, err
+	}
+
+	response := "HTTP/1.1 101 Switching Protocols\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + webSocketAccept(key) + "\r\n\r\n"
+	if _, err := conn.Write([]byte(response)); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return &webSocketConn{Conn: conn, reader: rw.Reader}, nil
+}
+
+// Adapts a WebSocket connection to the newline delimited stream the chat
+// room expects. Addresses and deadlines come from the underlying conn.
+type webSocketConn struct {
+	net.Conn
+	reader *bufio.Reader
+
+	// Rest of the current message that didn't fit into the last Read
+	pending []byte
+
+	// Pongs and close frames are written while reading, so writes need a lock
+	writeMu sync.Mutex
+	closed  bool
+}
+
+func (c *webSocketConn) Read(p []byte) (int, error) {
+	for len(c.pending) == 0 {
+		msg, err := c.readMessage()
+		if err != nil {
+			return 0, err
+		}
+		if len(msg) == 0 || msg[len(msg)-1] != '\n' {
+			msg = append(msg, '\n')
+		}
+		c.pending = msg
+	}
+	n := copy(p, c.pending)
+	c.pending = c.pending[n:]
+	return n, nil
+}
+
+// Reads frames until a complete text or binary message arrived,
+// answering control frames on the way
+func (c *webSocketConn) readMessage() ([]byte, error) {
+	var msg []byte
+	started := false
+	for {
+		fin, opcode, payload, err := c.readFrame()
+		if err != nil {
+			return nil, err
+		}
+
+		switch opcode {
+		case opPing:
+			if err := c.writeFrame(opPong, payload); err != nil {
+				return nil, err
+			}
+			continue
+		case opPong:
+			continue
+		case opClose:
+			c.closeWith(closeNormal)
+			return nil, io.EOF
+		case opText, opBinary:
+			if started {
+				c.closeWith(closeProtocolError)
+				return nil, errors.New("new message before the last one finished")
+			}
+			started = true
+		case opContinuation:
+			if !started {
+				c.closeWith(closeProtocolError)
+				return nil, errors.New("continuation without a message")
+			}
+		default:
+			c.closeWith(closeProtocolError)
+			return nil, errors.New("unknown websocket opcode")
+		}
+
+		msg = append(msg, payload...)
+		if len(msg) > MaxMessageLength {
+			c.closeWith(closeTooBig)
+			return nil, errors.New("message too long")
+		}
+		if fin {
+			return msg, nil
+		}
+	}
+}
+
+func (c *webSocketConn) readFrame() (bool, byte, []byte, error) {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(c.reader, header); err != nil {
+		return false, 0, nil, err
+	}
+	fin := header[0]&0x80 != 0
+	opcode := header[0] & 0x0F
+	masked := header[1]&0x80 != 0
+	length := uint64(header[1] & 0x7F)
+
+	// Clients always have to mask their frames
+	if !masked {
+		c.closeWith(closeProtocolError)
+		return false, 0, nil, errors.New("unmasked client frame")
+	}
+
+	switch length {
+	case 126:
+		ext := make([]byte, 2)
+		if _, err := io.ReadFull(c.reader, ext); err != nil {
+			return false, 0, nil, err
+		}
+		length = uint64(binary.BigEndian.Uint16(ext))
+	case 127:
+		ext := make([]byte, 8)
+		if _, err := io.ReadFull(c.reader, ext); err != nil {
+			return false, 0, nil, err
+		}
+		length = binary.BigEndian.Uint64(ext)
+	}
+	if length > MaxMessageLength {
+		c.closeWith(closeTooBig)
+		return false, 0, nil, errors.New("frame too long")
+	}
+
+	mask := make([]byte, 4)
+	if _, err := io.ReadFull(c.reader, mask); err != nil {
+		return false, 0, nil, err
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(c.reader, payload); err != nil {
+		return false, 0, nil, err
+	}
+	for i := range payload {
+		payload[i] ^= mask[i%4]
+	}
+	return fin, opcode, payload, nil
+}
+
+func (c *webSocketConn) writeFrame(opcode byte, payload []byte) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	if c.closed {
+		return net.ErrClosed
+	}
+	_, err := c.Conn.Write(encodeFrame(opcode, payload))
+	return err
+}
+
+func encodeFrame(opcode byte, payload []byte) []byte {
+	// Server frames are never masked
+	frame := []byte{0x80 | opcode}
+	switch {
+	case len(payload) < 126:
+		frame = append(frame, byte(len(payload)))
+	case len(payload) <= 0xFFFF:
+		frame = append(frame, 126, 0, 0)
+		binary.BigEndian.PutUint16(frame[2:], uint16(len(payload)))
+	default:
+		frame = append(frame, 127, 0, 0, 0, 0, 0, 0, 0, 0)
+		binary.BigEndian.PutUint64(frame[2:], uint64(len(payload)))
+	}
+	return append(frame, payload...)
+}
+
+// Each Write is sent as one text message
+func (c *webSocketConn) Write(p []byte) (int, error) {
+	if err := c.writeFrame(opText, p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Sends a close frame with the given status code, further writes fail.
+// Never waits on a stalled browser: if a write is still stuck the frame is
+// skipped, closing the conn gets that write unstuck.
+func (c *webSocketConn) closeWith(code uint16) {
+	if !c.writeMu.TryLock() {
+		return
+	}
+	defer c.writeMu.Unlock()
+	if c.closed {
+		return
+	}
+	c.closed = true
+
+	payload := make([]byte, 2)
+	binary.BigEndian.PutUint16(payload, code)
+	c.Conn.SetWriteDeadline(time.Now().Add(LastWordsTimeout))
+	c.Conn.Write(encodeFrame(opClose, payload))
+}
+
+func (c *webSocketConn) Close() error {
+	c.closeWith(closeNormal)
+	return c.Conn.Close()
+}
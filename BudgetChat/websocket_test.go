@@ -0,0 +1,212 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWebSocketAccept(t *testing.T) {
+	// Example from RFC 6455 section 1.3
+	accept := webSocketAccept("dGhlIHNhbXBsZSBub25jZQ==")
+	if accept != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+		t.Errorf("wrong accept value: %s", accept)
+	}
+}
+
+// Minimal browser stand-in
+type testWebSocketClient struct {
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+func dialTestWebSocket(t *testing.T, addr string) *testWebSocketClient {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	fmt.Fprintf(conn, "GET /ws HTTP/1.1\r\n"+
+		"Host: %s\r\n"+
+		"Upgrade: websocket\r\n"+
+		"Connection: keep-alive, Upgrade\r\n"+
+		"Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\n"+
+		"Sec-WebSocket-Version: 13\r\n\r\n", addr)
+
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("expected 101, got %s", resp.Status)
+	}
+	if resp.Header.Get("Sec-WebSocket-Accept") != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+		t.Fatalf("wrong accept header: %q", resp.Header.Get("Sec-WebSocket-Accept"))
+	}
+	return &testWebSocketClient{conn: conn, reader: reader}
+}
+
+func (c *testWebSocketClient) sendFrame(fin bool, opcode byte, payload string) {
+	first := opcode
+	if fin {
+		first |= 0x80
+	}
+	mask := []byte{0x12, 0x34, 0x56, 0x78}
+	frame := []byte{first, 0x80 | byte(len(payload))}
+	frame = append(frame, mask...)
+	for i := 0; i < len(payload); i++ {
+		frame = append(frame, payload[i]^mask[i%4])
+	}
+	c.conn.Write(frame)
+}
+
+func (c *testWebSocketClient) readFrame(t *testing.T) (byte, string) {
+	t.Helper()
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(c.reader, header); err != nil {
+		t.Fatal(err)
+	}
+	if header[1]&0x80 != 0 {
+		t.Fatal("server frames must not be masked")
+	}
+	length := int(header[1] & 0x7F)
+	if length == 126 {
+		ext := make([]byte, 2)
+		io.ReadFull(c.reader, ext)
+		length = int(binary.BigEndian.Uint16(ext))
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(c.reader, payload); err != nil {
+		t.Fatal(err)
+	}
+	return header[0] & 0x0F, string(payload)
+}
+
+func (c *testWebSocketClient) expectText(t *testing.T, expected string) {
+	t.Helper()
+	opcode, payload := c.readFrame(t)
+	if opcode != opText || payload != expected {
+		t.Fatalf("expected text %q, got opcode %d with %q", expected, opcode, payload)
+	}
+}
+
+func TestWebSocketSharesRoomWithTCP(t *testing.T) {
+	addr, chatRoom := startTestServer(t, DefaultRoomConfig())
+	server := httptest.NewServer(NewWebSocketHandler(chatRoom))
+	defer server.Close()
+
+	alice, aliceReader, _ := joinTestClient(t, addr, "alice")
+	defer alice.Close()
+
+	browser := dialTestWebSocket(t, strings.TrimPrefix(server.URL, "http://"))
+	defer browser.conn.Close()
+	browser.expectText(t, WelcomeMessage)
+	browser.sendFrame(true, opText, "bob")
+	browser.expectText(t, "* Users in Room: alice\n")
+	expectLine(t, aliceReader, "* bob joined this chat room\n")
+
+	// Fragmented message with a ping in between
+	browser.sendFrame(false, opText, "hello ")
+	browser.sendFrame(true, opPing, "are you there")
+	browser.sendFrame(true, opContinuation, "alice")
+	if opcode, payload := browser.readFrame(t); opcode != opPong || payload != "are you there" {
+		t.Fatalf("expected pong, got opcode %d with %q", opcode, payload)
+	}
+	expectLine(t, aliceReader, "[bob] hello alice\n")
+
+	fmt.Fprint(alice, "hi bob\n")
+	browser.expectText(t, "[alice] hi bob\n")
+
+	// Closing handshake
+	browser.sendFrame(true, opClose, "\x03\xe8")
+	if opcode, _ := browser.readFrame(t); opcode != opClose {
+		t.Fatalf("expected close frame, got opcode %d", opcode)
+	}
+	expectLine(t, aliceReader, "* bob left the chat room\n")
+}
+
+func TestWebSocketRejectsPlainRequests(t *testing.T) {
+	server := httptest.NewServer(NewWebSocketHandler(NewChatRoom(DefaultRoomConfig())))
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "/ws")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("expected 400, got %s", resp.Status)
+	}
+
+	resp, err = http.Get(server.URL + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if !strings.Contains(string(body), "new WebSocket(") {
+		t.Error("expected the embedded HTML client")
+	}
+}
+
+// A browser that stopped reading must not keep Close waiting, neither while
+// a write is stuck nor for the close frame itself
+func TestWebSocketCloseDoesNotBlock(t *testing.T) {
+	type test struct {
+		Name string
+		// Leave a write stuck before closing
+		StuckWrite bool
+	}
+	testCases := []test{
+		{Name: "idle"},
+		{Name: "stuck write", StuckWrite: true},
+	}
+
+	for _, tc := range testCases {
+		// Pipes don't buffer anything, writes wait until the browser reads
+		browser, server := net.Pipe()
+		conn := &webSocketConn{Conn: server, reader: bufio.NewReader(server)}
+
+		written := make(chan error, 1)
+		if tc.StuckWrite {
+			go func() {
+				_, err := conn.Write([]byte("nobody reads this\n"))
+				written <- err
+			}()
+			// Wait until the write holds the lock
+			for conn.writeMu.TryLock() {
+				conn.writeMu.Unlock()
+				time.Sleep(time.Millisecond)
+			}
+		}
+
+		closed := make(chan struct{})
+		go func() {
+			conn.Close()
+			close(closed)
+		}()
+		select {
+		case <-closed:
+		case <-time.After(LastWordsTimeout + time.Second):
+			t.Fatalf("%s: Close is stuck", tc.Name)
+		}
+		if tc.StuckWrite {
+			if err := <-written; err == nil {
+				t.Errorf("%s: stuck write should fail once the conn is closed", tc.Name)
+			}
+		}
+		if _, err := conn.Write([]byte("too late\n")); err == nil {
+			t.Errorf("%s: writing after Close should fail", tc.Name)
+		}
+		browser.Close()
+	}
+}
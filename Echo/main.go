@@ -1,8 +1,11 @@
 package main
 
 import (
+	"flag"
 	"log"
 	"net"
+
+	"lightstack.ml/tlsutil"
 )
 
 const (
@@ -31,8 +34,28 @@ func handleIncomingConnection(conn net.Conn) {
 	conn.Close()
 }
 
+// Accepts connections until the listener fails
+func Serve(listen net.Listener) error {
+	for {
+		conn, err := listen.Accept()
+		if err != nil {
+			return err
+		}
+		log.Println("Established Connection")
+		go handleIncomingConnection(conn)
+	}
+}
+
 func main() {
-	listen, err := net.Listen(TYPE, SERVER_IF+":"+SERVER_PORT)
+	tlsOptions := tlsutil.RegisterFlags()
+	flag.Parse()
+
+	tlsConfig, err := tlsOptions.ServerConfig()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	listen, err := tlsutil.Listen(TYPE, SERVER_IF+":"+SERVER_PORT, tlsConfig)
 	log.Printf("Listening on %s:%s\n", SERVER_IF, SERVER_PORT)
 
 	if err != nil {
@@ -41,12 +64,5 @@ func main() {
 
 	defer listen.Close()
 
-	for {
-		conn, err := listen.Accept()
-		log.Println("Established Connection")
-		if err != nil {
-			log.Fatal(err)
-		}
-		go handleIncomingConnection(conn)
-	}
+	log.Fatal(Serve(listen))
 }
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"crypto/tls"
+	"io"
+	"testing"
+	"time"
+
+	"lightstack.ml/tlsutil"
+)
+
+// The real server behind TLS, with client certificates required
+func TestEchoOverTLS(t *testing.T) {
+	serverConfig, clientConfig, err := tlsutil.NewTestConfigs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	listen, err := tlsutil.Listen("tcp", "127.0.0.1:0", serverConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listen.Close()
+	go Serve(listen)
+
+	conn, err := tls.Dial("tcp", listen.Addr().String(), clientConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	conn.Write([]byte("hello"))
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "hello" {
+		t.Errorf("expected echo of hello, got %q (%v)", buf, err)
+	}
+
+	// Trusts the server but has no certificate of its own
+	anonymous := clientConfig.Clone()
+	anonymous.Certificates = nil
+	rejected, err := tls.Dial("tcp", listen.Addr().String(), anonymous)
+	if err != nil {
+		return
+	}
+	defer rejected.Close()
+	rejected.SetDeadline(time.Now().Add(5 * time.Second))
+	// With TLS 1.3 the rejection only shows up once we read
+	rejected.Write([]byte("hello"))
+	if _, err := rejected.Read(make([]byte, 5)); err == nil {
+		t.Error("Server should not talk to clients without a certificate")
+	}
+}
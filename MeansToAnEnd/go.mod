@@ -1,3 +1,7 @@
 module lightstack.ml
 
 go 1.18
+
+require lightstack.ml/tlsutil v0.0.0
+
+replace lightstack.ml/tlsutil => ../TLSUtil
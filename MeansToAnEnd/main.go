@@ -3,8 +3,11 @@ package main
 import (
 	"encoding/binary"
 	"encoding/hex"
+	"flag"
 	"log"
 	"net"
+
+	"lightstack.ml/tlsutil"
 )
 
 const (
@@ -136,7 +139,15 @@ func handleIncomingConnection(conn net.Conn) {
 func main() {
 	// file, _ := os.OpenFile("/dev/null", os.O_RDWR, 0666)
 	// log.SetOutput(file)
-	listen, err := net.Listen(Type, Host+":"+Port)
+	tlsOptions := tlsutil.RegisterFlags()
+	flag.Parse()
+
+	tlsConfig, err := tlsOptions.ServerConfig()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	listen, err := tlsutil.Listen(Type, Host+":"+Port, tlsConfig)
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -145,12 +156,17 @@ func main() {
 	// Hoping this will grow
 	log.Printf("Started serving on %s:%s\n", Host, Port)
 
+	log.Fatal(Serve(listen))
+}
+
+// Accepts connections until the listener fails
+func Serve(listen net.Listener) error {
 	for {
 		conn, err := listen.Accept()
-		log.Println("Got Connection")
 		if err != nil {
-			log.Fatal(err)
+			return err
 		}
+		log.Println("Got Connection")
 		go handleIncomingConnection(conn)
 	}
 }
@@ -6,6 +6,7 @@ import (
 	"log"
 	"net"
 	"testing"
+	"time"
 )
 
 const SERVER_PORT = "13337"
@@ -57,8 +58,22 @@ func TestSerializeMessage(t *testing.T) {
 
 }
 
+// main() is started in the background, so give it a moment to listen
+func dialServer() (net.Conn, error) {
+	var conn net.Conn
+	var err error
+	for i := 0; i < 50; i++ {
+		conn, err = net.Dial("tcp", net.JoinHostPort(SERVER_IF, SERVER_PORT))
+		if err == nil {
+			return conn, nil
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	return nil, err
+}
+
 func TestConnectivity(t *testing.T) {
-	conn, err := net.Dial("tcp", fmt.Sprintf("%s:%s", SERVER_IF, SERVER_PORT))
+	conn, err := dialServer()
 	if err != nil {
 		t.Fatal(err)
 		return
@@ -106,7 +121,7 @@ func TestConnectivity(t *testing.T) {
 	}
 	conn.Close()
 
-	conn, err = net.Dial("tcp", fmt.Sprintf("%s:%s", SERVER_IF, SERVER_PORT))
+	conn, err = dialServer()
 	if err != nil {
 		t.Fatal(err)
 		return
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestBoguscoinEndToEnd(t *testing.T) {
+	type test struct {
+		Msg      string
+		Expected string
+	}
+
+	tony := FakeBogusCoinAddress
+	shortest := "7" + strings.Repeat("a", 25)
+	longest := "7" + strings.Repeat("B", 34)
+	testCases := []test{
+		{Msg: "Hi alice, please send payment to 7iKDZEwPZSqIvDnHvVN2r0hUWXD5rHX", Expected: "Hi alice, please send payment to " + tony},
+		{Msg: "7F1u3wSD5RbOHQmupo9nx4TnhQ is mine", Expected: tony + " is mine"},
+		{Msg: "send 7F1u3wSD5RbOHQmupo9nx4TnhQ please", Expected: "send " + tony + " please"},
+		{Msg: "Please pay the ticket price of 15 Boguscoins to one of these addresses: 7LOrwbDlS8NujgjddyogWgIM93MV5N2VR 7adNeSwJkMakpEcln9HEtthSRtxdmEHOT8T",
+			Expected: "Please pay the ticket price of 15 Boguscoins to one of these addresses: " + tony + " " + tony},
+		{Msg: shortest + " " + longest, Expected: tony + " " + tony},
+		// Not addresses: too short, too long, not starting with 7 or glued to
+		// other characters
+		{Msg: "7" + strings.Repeat("a", 24), Expected: "7" + strings.Repeat("a", 24)},
+		{Msg: longest + "B", Expected: longest + "B"},
+		{Msg: "8iKDZEwPZSqIvDnHvVN2r0hUWXD5rHX", Expected: "8iKDZEwPZSqIvDnHvVN2r0hUWXD5rHX"},
+		{Msg: "This is a product ID, not a Boguscoin: 7iKDZEwPZSqIvDnHvVN2r0hUWXD5rHX-1234", Expected: "This is a product ID, not a Boguscoin: 7iKDZEwPZSqIvDnHvVN2r0hUWXD5rHX-1234"},
+		{Msg: "no addresses here", Expected: "no addresses here"},
+	}
+
+	chatAddr := startFakeChat(t)
+	// alice talks through the proxy, bob straight to the server, so bob sees
+	// what the server got and what bob sends only gets rewritten for alice
+	alice := joinChat(t, dialThroughProxy(t, newChatProxy(t, nil), chatAddr), "alice")
+	bobConn, err := net.Dial("tcp", chatAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bobConn.Close()
+	bob := joinChat(t, bobConn, "bob")
+	alice.expect("* bob has entered the room")
+
+	for _, tc := range testCases {
+		alice.send(tc.Msg)
+		bob.expect("[alice] " + tc.Expected)
+
+		bob.send(tc.Msg)
+		alice.expect("[bob] " + tc.Expected)
+	}
+
+	// Server messages get rewritten as well, even when the address is a name
+	carolConn, err := net.Dial("tcp", chatAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	joinChat(t, carolConn, "7iKDZEwPZSqIvDnHvVN2r0hUWXD5rHX")
+	alice.expect("* " + tony + " has entered the room")
+	bob.expect("* 7iKDZEwPZSqIvDnHvVN2r0hUWXD5rHX has entered the room")
+	carolConn.Close()
+	alice.expect("* " + tony + " has left the room")
+}
+
+// Both ends of a conversation behind their own proxy, like the Protohackers
+// checker runs it
+func TestBoguscoinBetweenProxiedClients(t *testing.T) {
+	chatAddr := startFakeChat(t)
+	alice := joinChat(t, dialThroughProxy(t, newChatProxy(t, nil), chatAddr), "alice")
+	bob := joinChat(t, dialThroughProxy(t, newChatProxy(t, nil), chatAddr), "bob")
+	alice.expect("* bob has entered the room")
+
+	alice.send("bob, send 15 Boguscoins to 7adNeSwJkMakpEcln9HEtthSRtxdmEHOT8T")
+	bob.expect("[alice] bob, send 15 Boguscoins to " + FakeBogusCoinAddress)
+	bob.send("7LOrwbDlS8NujgjddyogWgIM93MV5N2VR is where I sent them")
+	alice.expect("[bob] " + FakeBogusCoinAddress + " is where I sent them")
+
+	bob.conn.Close()
+	alice.expect("* bob has left the room")
+}
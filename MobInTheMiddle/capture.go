@@ -0,0 +1,231 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// One frame as it passed through the proxy
+type CaptureRecord struct {
+	Time      time.Time `json:"time"`
+	Direction Direction `json:"direction"`
+	Original  []byte    `json:"original"`
+	// What was actually sent on, nil if the frame got dropped
+	Rewritten []byte `json:"rewritten"`
+	// Sent on as it was without going through the pipeline: pieces of
+	// frames that were too long, or cut short by the end of the stream
+	Passthrough bool `json:"passthrough,omitempty"`
+}
+
+func (d Direction) String() string {
+	switch d {
+	case ClientToServer:
+		return "client-to-server"
+	case ServerToClient:
+		return "server-to-client"
+	}
+	return "both"
+}
+
+func (d Direction) MarshalText() ([]byte, error) {
+	return []byte(d.String()), nil
+}
+
+func (d *Direction) UnmarshalText(text []byte) error {
+	var err error
+	*d, err = ParseDirection(string(text))
+	return err
+}
+
+// Records one session as JSON Lines of CaptureRecord. A nil Capture
+// records nothing.
+type Capture struct {
+	mu      sync.Mutex
+	file    *os.File
+	encoder *json.Encoder
+}
+
+// Creates a new capture file in dir, named after the time and the client
+func NewCapture(dir string, client net.Addr) (*Capture, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	name := fmt.Sprintf("%s-%s.jsonl", time.Now().UTC().Format("20060102T150405.000000000"), client)
+	// Colons in IPv6 addresses and ports don't go well with every file system
+	name = strings.NewReplacer(":", "_", "[", "", "]", "").Replace(name)
+	file, err := os.Create(filepath.Join(dir, name))
+	if err != nil {
+		return nil, err
+	}
+	return &Capture{file: file, encoder: json.NewEncoder(file)}, nil
+}
+
+func (c *Capture) Record(direction Direction, original []byte, rewritten []byte, passthrough bool) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	record := CaptureRecord{Time: time.Now(), Direction: direction, Original: original, Rewritten: rewritten, Passthrough: passthrough}
+	if err := c.encoder.Encode(record); err != nil {
+		log.Println("Can't write capture: ", err)
+	}
+}
+
+func (c *Capture) Close() error {
+	if c == nil {
+		return nil
+	}
+	return c.file.Close()
+}
+
+func ReadCapture(path string) ([]CaptureRecord, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var records []CaptureRecord
+	scanner := bufio.NewScanner(file)
+	// Base64 makes frames a third bigger
+	scanner.Buffer(make([]byte, 0, 64*1024), 2*MaxJSONLineLength)
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		var record CaptureRecord
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", path, lineNumber, err)
+		}
+		records = append(records, record)
+	}
+	return records, scanner.Err()
+}
+
+// Feeds every recorded frame through the proxy's pipelines again and
+// returns a description of every frame that comes out differently
+func ReplayOffline(records []CaptureRecord, proxy *Proxy) []string {
+	var mismatches []string
+	for i, record := range records {
+		pipeline := proxy.ClientToServer
+		if record.Direction == ServerToClient {
+			pipeline = proxy.ServerToClient
+		}
+		rewritten := record.Original
+		if !record.Passthrough {
+			// Transformers may change frames in place
+			rewritten = pipeline.transform(append([]byte(nil), record.Original...))
+		}
+		if !bytes.Equal(rewritten, record.Rewritten) || (rewritten == nil) != (record.Rewritten == nil) {
+			mismatches = append(mismatches, fmt.Sprintf("frame %d (%s): %q was rewritten to %q, now %q",
+				i+1, record.Direction, record.Original, record.Rewritten, rewritten))
+		}
+	}
+	return mismatches
+}
+
+// Plays the client's side of the session against a live upstream and
+// returns a description of every server frame that differs from the
+// recording. Waits at most timeout for each server frame.
+func ReplayLive(records []CaptureRecord, proxy *Proxy, timeout time.Duration) ([]string, error) {
+	conn, upstream, err := proxy.Upstreams.Dial()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	log.Printf("Replaying against %s", upstream.Addr)
+
+	var mismatches []string
+	reader := bufio.NewReader(conn)
+	for i, record := range records {
+		switch record.Direction {
+		case ClientToServer:
+			frame := record.Original
+			if !record.Passthrough {
+				frame = proxy.ClientToServer.transform(append([]byte(nil), record.Original...))
+			}
+			if frame == nil {
+				continue
+			}
+			if _, err := conn.Write(frame); err != nil {
+				return mismatches, err
+			}
+		case ServerToClient:
+			conn.SetReadDeadline(time.Now().Add(timeout))
+			var frame []byte
+			var err error
+			if record.Passthrough {
+				// Pieces don't follow the framing, take exactly as much
+				frame = make([]byte, len(record.Original))
+				_, err = io.ReadFull(reader, frame)
+			} else {
+				frame, err = proxy.ServerToClient.Framer.ReadFrame(reader)
+			}
+			if err != nil {
+				return append(mismatches, fmt.Sprintf("frame %d (%s): expected %q, got %v", i+1, record.Direction, record.Original, err)), nil
+			}
+			if !bytes.Equal(frame, record.Original) {
+				mismatches = append(mismatches, fmt.Sprintf("frame %d (%s): expected %q, got %q", i+1, record.Direction, record.Original, frame))
+			}
+		}
+	}
+	return mismatches, nil
+}
+
+// The "replay" subcommand, e.g.
+// mobInTheMiddle replay -rules rules.json captures/20221001T120000-127.0.0.1_5555.jsonl
+func runReplay(args []string) error {
+	flags := flag.NewFlagSet("replay", flag.ExitOnError)
+	protocol := flags.String("protocol", "chat", "what the capture was recorded with: chat, jsonl, means or raw")
+	rulesFile := flags.String("rules", "", "JSON file with the rewrite rules to check")
+	upstreamAddr := flags.String("upstream", "", "replay the client side against this live server instead of only checking the rewrites")
+	timeout := flags.Duration("timeout", 5*time.Second, "how long to wait for each server frame when replaying against a live server")
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		return errors.New("usage: replay [flags] <capture file>")
+	}
+
+	records, err := ReadCapture(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	rules, err := loadRules(*protocol, *rulesFile)
+	if err != nil {
+		return err
+	}
+	proxy, err := NewProtocolProxy(*protocol, &UpstreamPool{}, rules, false)
+	if err != nil {
+		return err
+	}
+
+	var mismatches []string
+	if *upstreamAddr == "" {
+		mismatches = ReplayOffline(records, proxy)
+	} else {
+		proxy.Upstreams.Upstreams = []Upstream{{Addr: *upstreamAddr}}
+		proxy.Upstreams.ConnectTimeout = *timeout
+		mismatches, err = ReplayLive(records, proxy, *timeout)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, mismatch := range mismatches {
+		fmt.Println(mismatch)
+	}
+	if len(mismatches) > 0 {
+		return fmt.Errorf("%d of %d frames differ", len(mismatches), len(records))
+	}
+	fmt.Printf("All %d frames match\n", len(records))
+	return nil
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Upstream that sends every line straight back
+func startEchoUpstream(t *testing.T) string {
+	listen, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listen.Close() })
+	go func() {
+		for {
+			conn, err := listen.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return listen.Addr().String()
+}
+
+func TestDirectionJSON(t *testing.T) {
+	for _, direction := range []Direction{ClientToServer, ServerToClient, BothDirections} {
+		encoded, err := json.Marshal(direction)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var decoded Direction
+		if err := json.Unmarshal(encoded, &decoded); err != nil || decoded != direction {
+			t.Errorf("%s: encoded as %s, decoded to %s (%v)", direction, encoded, decoded, err)
+		}
+	}
+}
+
+func TestCaptureAndReplay(t *testing.T) {
+	dir := t.TempDir()
+	upstreamAddr := startEchoUpstream(t)
+	proxy := newChatProxy(t, nil)
+	proxy.CaptureDir = dir
+	conn := dialThroughProxy(t, proxy, upstreamAddr)
+
+	reader := bufio.NewReader(conn)
+	for _, line := range []string{"hi there\n", "pay 7iKDZEwPZSqIvDnHvVN2r0hUWXD5rHX now\n"} {
+		conn.Write([]byte(line))
+		if _, err := reader.ReadString('\n'); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	files, err := filepath.Glob(filepath.Join(dir, "*.jsonl"))
+	if err != nil || len(files) != 1 {
+		t.Fatalf("expected one capture file, got %v (%v)", files, err)
+	}
+	records, err := ReadCapture(files[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	type expectedRecord struct {
+		Direction Direction
+		Original  string
+		Rewritten string
+	}
+	rewritten := "pay " + FakeBogusCoinAddress + " now\n"
+	expected := []expectedRecord{
+		{Direction: ClientToServer, Original: "hi there\n", Rewritten: "hi there\n"},
+		{Direction: ServerToClient, Original: "hi there\n", Rewritten: "hi there\n"},
+		{Direction: ClientToServer, Original: "pay 7iKDZEwPZSqIvDnHvVN2r0hUWXD5rHX now\n", Rewritten: rewritten},
+		{Direction: ServerToClient, Original: rewritten, Rewritten: rewritten},
+	}
+	if len(records) != len(expected) {
+		t.Fatalf("expected %d records, got %d", len(expected), len(records))
+	}
+	for i, record := range records {
+		got := expectedRecord{Direction: record.Direction, Original: string(record.Original), Rewritten: string(record.Rewritten)}
+		if got != expected[i] || record.Time.IsZero() {
+			t.Errorf("record %d: expected: %+v, got: %+v", i, expected[i], got)
+		}
+	}
+
+	// The same rules give the same result
+	if mismatches := ReplayOffline(records, newChatProxy(t, nil)); len(mismatches) != 0 {
+		t.Errorf("unexpected mismatches: %q", mismatches)
+	}
+	// Without rules the address isn't rewritten any more
+	plain, _ := NewProtocolProxy("chat", nil, NewRuleEngine(nil), false)
+	if mismatches := ReplayOffline(records, plain); len(mismatches) != 1 {
+		t.Errorf("expected one mismatch, got %q", mismatches)
+	}
+
+	// The echo server still answers like it did when recording
+	live := newChatProxy(t, &UpstreamPool{Upstreams: []Upstream{{Addr: upstreamAddr}}})
+	mismatches, err := ReplayLive(records, live, 5*time.Second)
+	if err != nil || len(mismatches) != 0 {
+		t.Errorf("unexpected mismatches: %q (%v)", mismatches, err)
+	}
+}
+
+// Pieces of frames went through untouched, replaying them must not
+// complain that the rules would have rewritten them
+func TestReplayPassthrough(t *testing.T) {
+	dir := t.TempDir()
+	upstreamAddr := startEchoUpstream(t)
+	proxy := newChatProxy(t, nil)
+	proxy.CaptureDir = dir
+	conn := dialThroughProxy(t, proxy, upstreamAddr)
+
+	// Too long to rewrite, and cut short by the client hanging up
+	long := "pay 7iKDZEwPZSqIvDnHvVN2r0hUWXD5rHX " + strings.Repeat("x", 2*MaxMessageLength) + "\n"
+	tail := "pay 7iKDZEwPZSqIvDnHvVN2r0hUWXD5rHX"
+	conn.Write([]byte(long))
+	reader := bufio.NewReader(conn)
+	if line, err := reader.ReadString('\n'); err != nil || line != long {
+		t.Fatalf("expected the long line back unchanged, got %d bytes (%v)", len(line), err)
+	}
+	conn.Write([]byte(tail))
+	conn.(*net.TCPConn).CloseWrite()
+	if rest, err := io.ReadAll(reader); err != nil || string(rest) != tail {
+		t.Fatalf("expected %q back, got %q (%v)", tail, rest, err)
+	}
+
+	files, err := filepath.Glob(filepath.Join(dir, "*.jsonl"))
+	if err != nil || len(files) != 1 {
+		t.Fatalf("expected one capture file, got %v (%v)", files, err)
+	}
+	records, err := ReadCapture(files[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, record := range records {
+		if !record.Passthrough {
+			t.Errorf("record %d should be marked as passed through: %+v", i, record)
+		}
+	}
+
+	if mismatches := ReplayOffline(records, newChatProxy(t, nil)); len(mismatches) != 0 {
+		t.Errorf("unexpected mismatches: %q", mismatches)
+	}
+	live := newChatProxy(t, &UpstreamPool{Upstreams: []Upstream{{Addr: upstreamAddr}}})
+	mismatches, err := ReplayLive(records, live, 5*time.Second)
+	if err != nil || len(mismatches) != 0 {
+		t.Errorf("unexpected mismatches: %q (%v)", mismatches, err)
+	}
+}
+
+func TestReadBrokenCapture(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "broken.jsonl")
+	os.WriteFile(path, []byte(`{"direction": "sideways"}`+"\n"), 0644)
+	if _, err := ReadCapture(path); err == nil {
+		t.Error("Unknown directions should be refused")
+	}
+}
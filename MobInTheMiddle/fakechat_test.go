@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Just enough of the Budget Chat protocol to put the proxy in front of it.
+// BudgetChat's ChatRoom lives in a main package of another module, so it
+// can't be imported here.
+type fakeChatServer struct {
+	mu    sync.Mutex
+	users map[string]net.Conn
+}
+
+// Starts a fake chat server on a random local port and returns its address
+func startFakeChat(t *testing.T) string {
+	listen, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listen.Close() })
+
+	server := &fakeChatServer{users: make(map[string]net.Conn)}
+	go func() {
+		for {
+			conn, err := listen.Accept()
+			if err != nil {
+				return
+			}
+			go server.handleConnection(conn)
+		}
+	}()
+	return listen.Addr().String()
+}
+
+func (s *fakeChatServer) handleConnection(conn net.Conn) {
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	conn.Write([]byte("Welcome to budgetchat! What shall I call you?\n"))
+	name, err := reader.ReadString('\n')
+	name = strings.TrimSuffix(name, "\n")
+	if err != nil || !validChatName(name) {
+		conn.Write([]byte("* Illegal name\n"))
+		return
+	}
+
+	s.mu.Lock()
+	if _, taken := s.users[name]; taken {
+		s.mu.Unlock()
+		conn.Write([]byte("* Name taken\n"))
+		return
+	}
+	var others []string
+	for other := range s.users {
+		others = append(others, other)
+	}
+	s.users[name] = conn
+	s.mu.Unlock()
+
+	conn.Write([]byte(fmt.Sprintf("* The room contains: %s\n", strings.Join(others, ", "))))
+	s.broadcast(name, fmt.Sprintf("* %s has entered the room\n", name))
+	defer func() {
+		s.mu.Lock()
+		delete(s.users, name)
+		s.mu.Unlock()
+		s.broadcast(name, fmt.Sprintf("* %s has left the room\n", name))
+	}()
+
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return
+		}
+		s.broadcast(name, fmt.Sprintf("[%s] %s", name, line))
+	}
+}
+
+// Sends msg to everyone but from
+func (s *fakeChatServer) broadcast(from string, msg string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for name, conn := range s.users {
+		if name != from {
+			conn.Write([]byte(msg))
+		}
+	}
+}
+
+func validChatName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for _, c := range name {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9') {
+			return false
+		}
+	}
+	return true
+}
+
+// Scripted chat user
+type chatClient struct {
+	t      *testing.T
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+// Joins the chat at conn as name and skips everything up to the list of
+// users in the room
+func joinChat(t *testing.T, conn net.Conn, name string) *chatClient {
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	client := &chatClient{t: t, conn: conn, reader: bufio.NewReader(conn)}
+	client.expectPrefix("Welcome")
+	client.send(name)
+	client.expectPrefix("* The room contains:")
+	return client
+}
+
+func (c *chatClient) send(line string) {
+	if _, err := c.conn.Write([]byte(line + "\n")); err != nil {
+		c.t.Fatal(err)
+	}
+}
+
+func (c *chatClient) readLine() string {
+	line, err := c.reader.ReadString('\n')
+	if err != nil {
+		c.t.Fatalf("expected a line, got %q (%v)", line, err)
+	}
+	return strings.TrimSuffix(line, "\n")
+}
+
+func (c *chatClient) expect(expected string) {
+	if line := c.readLine(); line != expected {
+		c.t.Errorf("expected: %q, got: %q", expected, line)
+	}
+}
+
+func (c *chatClient) expectPrefix(prefix string) {
+	if line := c.readLine(); !strings.HasPrefix(line, prefix) {
+		c.t.Fatalf("expected a line starting with %q, got: %q", prefix, line)
+	}
+}
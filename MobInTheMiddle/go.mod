@@ -2,4 +2,9 @@ module lightstack.ml/budgetChat
 
 go 1.18
 
-require golang.org/x/exp v0.0.0-20220921164117-439092de6870 
+require (
+	golang.org/x/exp v0.0.0-20220921164117-439092de6870
+	lightstack.ml/tlsutil v0.0.0
+)
+
+replace lightstack.ml/tlsutil => ../TLSUtil
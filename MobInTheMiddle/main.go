@@ -1,12 +1,16 @@
 package main
 
 import (
-	"errors"
-	"fmt"
+	"flag"
 	"log"
 	"net"
-	"regexp"
-	"strings"
+	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
+	"time"
+
+	"lightstack.ml/tlsutil"
 )
 
 const (
@@ -18,140 +22,94 @@ const (
 	RemoteChatServerPort   = 16963
 	RemoteChatServerDomain = "chat.protohackers.com"
 	FakeBogusCoinAddress   = "7YWHMfk9JZe0LM0g1ZauHuiSxhI"
-	RegexPattern           = `^7[[:alnum:]]{25,35}$`
-)
+	BoguscoinPattern       = `7[[:alnum:]]{25,34}`
 
-func ReplaceAddress(msg string) string {
-	re := regexp.MustCompile(RegexPattern)
+	UpstreamUnavailableMessage = "Sorry, the server can't be reached right now, please try again later\n"
+)
 
-	if len(msg) > 0 {
-		msg = msg[:len(msg)-1]
+// Rules from rulesFile, or the default ones for protocol if it is empty
+func loadRules(protocol string, rulesFile string) (*RuleEngine, error) {
+	if rulesFile != "" {
+		return LoadRuleEngine(rulesFile)
 	}
-
-	// Split
-	parts := strings.Split(msg, " ")
-	for i, p := range parts {
-		if re.MatchString(p) {
-			parts[i] = FakeBogusCoinAddress
-		}
+	// Boguscoin addresses only make sense in chats
+	if protocol == "chat" {
+		return NewRuleEngine(DefaultRules()), nil
 	}
-
-	return strings.Join(parts, " ") + "\n"
+	return NewRuleEngine(nil), nil
 }
 
-func ReadMessage(conn net.Conn, buf *[]byte) error {
-	oneByteBuf := make([]byte, 1)
-	for i := 0; i < MaxMessageLength; i++ {
-		_, err := conn.Read(oneByteBuf)
-		if err != nil {
-			return err
-		}
-
-		*buf = append(*buf, oneByteBuf...)
-
-		// Include newline into message
-		if oneByteBuf[0] == '\n' {
-			return nil
+func main() {
+	if len(os.Args) > 1 && os.Args[1] == "replay" {
+		if err := runReplay(os.Args[2:]); err != nil {
+			log.Fatal(err)
 		}
+		return
 	}
-	return errors.New("message too long")
-}
-
-func handleClientToServer(clientConn net.Conn, serverConn net.Conn) {
-	// Always read from clientConn, replace and then write to server Conn
-	for {
-		tempBuf := make([]byte, 0)
-		err := ReadMessage(clientConn, &tempBuf)
-		if err != nil {
-			log.Println("ERROR: cant read from client")
-			clientConn.Close()
-			serverConn.Close()
-			return
-		}
 
-		// Replace
-		replacedMsg := ReplaceAddress(string(tempBuf))
-
-		if len(replacedMsg) > 0 && replacedMsg[len(replacedMsg)-1] != '\n' {
-			replacedMsg += "\n"
-		}
-		log.Print(replacedMsg)
-
-		// And relay to server
-		_, err = serverConn.Write([]byte(replacedMsg))
-		if err != nil {
-			log.Println("ERROR: cant write to server!")
-			clientConn.Close()
-			serverConn.Close()
-			return
-		}
+	upstreamAddrs := flag.String("upstream", net.JoinHostPort(RemoteChatServerDomain, strconv.Itoa(RemoteChatServerPort)), "comma separated host:port list of servers to forward to")
+	strategy := flag.String("upstream-strategy", "failover", "how to pick an upstream: failover or round-robin")
+	connectTimeout := flag.Duration("connect-timeout", 5*time.Second, "how long connecting to one upstream may take")
+	retries := flag.Int("retries", 2, "how often to try every upstream again if none of them answered")
+	retryDelay := flag.Duration("retry-delay", 500*time.Millisecond, "how long to wait before trying the upstreams again")
+	rulesFile := flag.String("rules", "", "JSON file with rewrite rules, by default Boguscoin addresses get replaced")
+	protocol := flag.String("protocol", "chat", "what the upstream speaks: chat, jsonl, means or raw")
+	logFrames := flag.Bool("log-frames", true, "log every message passing through the proxy")
+	captureDir := flag.String("capture-dir", "", "record every session to a file in this directory, see the replay subcommand")
+	rulesWatch := flag.Duration("rules-watch", 0, "check the rules file for changes this often, 0 only reloads on SIGHUP")
+	tlsOptions := tlsutil.RegisterFlags()
+	upstreamTLSOptions := RegisterUpstreamTLSFlags()
+	flag.Parse()
+
+	tlsConfig, err := tlsOptions.ServerConfig()
+	if err != nil {
+		log.Fatal(err)
 	}
-}
-
-func handleServerToClient(clientConn net.Conn, serverConn net.Conn) {
-	for {
-		// Read from server
-		tempBuf := make([]byte, 0)
-		err := ReadMessage(serverConn, &tempBuf)
-		if err != nil {
-			log.Println("ERROR: cant read from server")
-			clientConn.Close()
-			serverConn.Close()
-			return
-		}
-
-		// Replace
-		replacedMsg := ReplaceAddress(string(tempBuf))
-
-		if len(replacedMsg) > 0 && replacedMsg[len(replacedMsg)-1] != '\n' {
-			replacedMsg += "\n"
-		}
-
-		log.Print(replacedMsg)
-		// And relay to client
-		_, err = clientConn.Write([]byte(replacedMsg))
-		if err != nil {
-			log.Println("ERROR: cant write to client!")
-			clientConn.Close()
-			serverConn.Close()
-			return
-		}
+	// The server name gets filled in per upstream
+	upstreamTLS, err := upstreamTLSOptions.ClientConfig("")
+	if err != nil {
+		log.Fatal(err)
 	}
-}
-
-func handleIncomingConnection(clientConn net.Conn) {
-
-	// Establish connection to real chat server
-	log.Printf("%s:%d", RemoteChatServerDomain, RemoteChatServerPort)
-	chatServerConn, err := net.Dial("tcp", fmt.Sprintf("%s:%d", RemoteChatServerDomain, RemoteChatServerPort))
+	upstreams := &UpstreamPool{
+		ConnectTimeout: *connectTimeout,
+		Retries:        *retries,
+		RetryDelay:     *retryDelay,
+	}
+	upstreams.Upstreams, err = ParseUpstreams(*upstreamAddrs, upstreamTLS)
 	if err != nil {
-		log.Fatalf(err.Error())
+		log.Fatal(err)
+	}
+	upstreams.Strategy, err = ParseSelectionStrategy(*strategy)
+	if err != nil {
+		log.Fatal(err)
 	}
 
-	// Making sure all connections get closed
-	defer clientConn.Close()
-	defer chatServerConn.Close()
-
-	go handleClientToServer(clientConn, chatServerConn)
-	go handleServerToClient(clientConn, chatServerConn)
-
-	zeroBuf := make([]byte, 0)
-	for {
-		_, err := chatServerConn.Read(zeroBuf)
-		if err != nil {
-			break
-		}
-
-		_, err = clientConn.Read(zeroBuf)
-		if err != nil {
-			break
+	rules, err := loadRules(*protocol, *rulesFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if *rulesFile != "" {
+		reload := make(chan os.Signal, 1)
+		signal.Notify(reload, syscall.SIGHUP)
+		go func() {
+			for range reload {
+				if err := rules.Reload(); err != nil {
+					log.Println("Keeping old rules: ", err)
+				}
+			}
+		}()
+		if *rulesWatch > 0 {
+			go rules.Watch(*rulesWatch)
 		}
 	}
-}
 
-func main() {
+	proxy, err := NewProtocolProxy(*protocol, upstreams, rules, *logFrames)
+	if err != nil {
+		log.Fatal(err)
+	}
+	proxy.CaptureDir = *captureDir
 
-	listen, err := net.Listen(Type, Host+":"+ListenPort)
+	listen, err := tlsutil.Listen(Type, Host+":"+ListenPort, tlsConfig)
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -159,13 +117,5 @@ func main() {
 
 	log.Printf("Started serving on %s:%s\n", Host, ListenPort)
 
-	for {
-		conn, err := listen.Accept()
-		log.Println("Got Connection")
-		if err != nil {
-			log.Fatal(err)
-		}
-
-		go handleIncomingConnection(conn)
-	}
+	log.Fatal(proxy.Serve(listen))
 }
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+)
+
+const MaxJSONLineLength = 1 << 20
+
+// Applies the rewrite rules to every line going in direction
+func RuleTransformer(rules *RuleEngine, direction Direction) Transformer {
+	return TransformerFunc(func(frame []byte) []byte {
+		return []byte(rules.Apply(string(frame), direction))
+	})
+}
+
+// Logs every frame going in direction and what transformer, which may be
+// nil, made of it. describe makes frames readable.
+func LogTransformer(direction Direction, transformer Transformer, describe func(frame []byte) string) Transformer {
+	return TransformerFunc(func(frame []byte) []byte {
+		// Before the transformer gets a chance to change it in place
+		original := describe(frame)
+		if transformer != nil {
+			frame = transformer.Transform(frame)
+		}
+
+		switch {
+		case frame == nil:
+			log.Printf("%s: %s dropped", direction, original)
+		case describe(frame) != original:
+			log.Printf("%s: %s rewritten to %s", direction, original, describe(frame))
+		default:
+			log.Printf("%s: %s", direction, original)
+		}
+		return frame
+	})
+}
+
+func describeText(frame []byte) string {
+	return fmt.Sprintf("%q", frame)
+}
+
+func describeJSON(frame []byte) string {
+	var compact bytes.Buffer
+	if err := json.Compact(&compact, bytes.TrimSpace(frame)); err != nil {
+		return fmt.Sprintf("invalid JSON %q", frame)
+	}
+	return compact.String()
+}
+
+// MeansToAnEnd requests are a type byte and two big endian int32s
+func describeMeansToAnEndRequest(frame []byte) string {
+	if len(frame) != 9 {
+		return "short request " + hex.EncodeToString(frame)
+	}
+	first := int32(binary.BigEndian.Uint32(frame[1:5]))
+	second := int32(binary.BigEndian.Uint32(frame[5:9]))
+	switch frame[0] {
+	case 'I':
+		return fmt.Sprintf("insert timestamp=%d price=%d", first, second)
+	case 'Q':
+		return fmt.Sprintf("query mintime=%d maxtime=%d", first, second)
+	}
+	return "unknown request " + hex.EncodeToString(frame)
+}
+
+// MeansToAnEnd answers every query with a big endian int32
+func describeMeansToAnEndResponse(frame []byte) string {
+	if len(frame) != 4 {
+		return "short response " + hex.EncodeToString(frame)
+	}
+	return fmt.Sprintf("mean=%d", int32(binary.BigEndian.Uint32(frame)))
+}
+
+// Builds a proxy for one of the protocols it knows:
+//
+//	chat   newline delimited text, e.g. BudgetChat, rewritten with rules
+//	jsonl  JSON lines, e.g. PrimeTime, rewritten with rules
+//	means  MeansToAnEnd's 9 byte requests and 4 byte responses
+//	raw    anything, passed on as it arrives
+func NewProtocolProxy(protocol string, upstreams *UpstreamPool, rules *RuleEngine, logFrames bool) (*Proxy, error) {
+	proxy := &Proxy{Upstreams: upstreams}
+	var describeRequest, describeResponse func([]byte) string
+
+	switch protocol {
+	case "chat", "jsonl":
+		framer := LineFramer{MaxLength: MaxMessageLength}
+		describeRequest, describeResponse = describeText, describeText
+		if protocol == "jsonl" {
+			framer.MaxLength = MaxJSONLineLength
+			describeRequest, describeResponse = describeJSON, describeJSON
+		}
+		proxy.ClientToServer = Pipeline{Framer: framer, Transformer: RuleTransformer(rules, ClientToServer)}
+		proxy.ServerToClient = Pipeline{Framer: framer, Transformer: RuleTransformer(rules, ServerToClient)}
+	case "means":
+		proxy.ClientToServer = Pipeline{Framer: FixedFramer{Size: 9}}
+		proxy.ServerToClient = Pipeline{Framer: FixedFramer{Size: 4}}
+		describeRequest, describeResponse = describeMeansToAnEndRequest, describeMeansToAnEndResponse
+	case "raw":
+		proxy.ClientToServer = Pipeline{Framer: ChunkFramer{}}
+		proxy.ServerToClient = Pipeline{Framer: ChunkFramer{}}
+		describeRequest, describeResponse = hex.EncodeToString, hex.EncodeToString
+	default:
+		return nil, fmt.Errorf("unknown protocol %q (want chat, jsonl, means or raw)", protocol)
+	}
+
+	if logFrames {
+		proxy.ClientToServer.Transformer = LogTransformer(ClientToServer, proxy.ClientToServer.Transformer, describeRequest)
+		proxy.ServerToClient.Transformer = LogTransformer(ServerToClient, proxy.ServerToClient.Transformer, describeResponse)
+	}
+	return proxy, nil
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"sync"
+)
+
+// Splits a byte stream into the messages of a protocol
+type Framer interface {
+	// Reads the next message including its delimiter, if the protocol has
+	// one. If the stream ends in the middle of a message, what there is of
+	// it comes with the error.
+	ReadFrame(r *bufio.Reader) ([]byte, error)
+}
+
+// Returned by framers along with the start of a message too long to keep in
+// memory, the rest of it follows with the next reads
+var ErrFrameTooLong = errors.New("frame too long")
+
+// Changes messages on their way through the proxy. Returning nil drops the
+// message.
+type Transformer interface {
+	Transform(frame []byte) []byte
+}
+
+type TransformerFunc func(frame []byte) []byte
+
+func (f TransformerFunc) Transform(frame []byte) []byte {
+	return f(frame)
+}
+
+// Runs every transformer in order, each one sees what the last one returned
+type TransformerChain []Transformer
+
+func (chain TransformerChain) Transform(frame []byte) []byte {
+	for _, transformer := range chain {
+		if frame == nil {
+			return nil
+		}
+		frame = transformer.Transform(frame)
+	}
+	return frame
+}
+
+// Newline delimited messages, e.g. chat or JSON lines. Lines longer than
+// MaxLength are handed out in pieces of at least MaxLength bytes.
+type LineFramer struct {
+	MaxLength int
+}
+
+func (f LineFramer) ReadFrame(r *bufio.Reader) ([]byte, error) {
+	var frame []byte
+	for {
+		chunk, err := r.ReadSlice('\n')
+		frame = append(frame, chunk...)
+		if err != bufio.ErrBufferFull {
+			return frame, err
+		}
+		if f.MaxLength > 0 && len(frame) >= f.MaxLength {
+			return frame, ErrFrameTooLong
+		}
+	}
+}
+
+// Messages of a fixed size, e.g. 9 byte MeansToAnEnd requests
+type FixedFramer struct {
+	Size int
+}
+
+func (f FixedFramer) ReadFrame(r *bufio.Reader) ([]byte, error) {
+	frame := make([]byte, f.Size)
+	n, err := io.ReadFull(r, frame)
+	return frame[:n], err
+}
+
+// No framing at all, whatever arrives gets passed on as it is
+type ChunkFramer struct{}
+
+func (ChunkFramer) ReadFrame(r *bufio.Reader) ([]byte, error) {
+	// Block for at least one byte, then take whatever else is buffered
+	if _, err := r.Peek(1); err != nil {
+		return nil, err
+	}
+	frame := make([]byte, r.Buffered())
+	_, err := io.ReadFull(r, frame)
+	return frame, err
+}
+
+// How messages travelling in one direction are framed and transformed
+type Pipeline struct {
+	Framer Framer
+	// Optional
+	Transformer Transformer
+}
+
+func (p Pipeline) transform(frame []byte) []byte {
+	if p.Transformer == nil {
+		return frame
+	}
+	return p.Transformer.Transform(frame)
+}
+
+// Sits between clients and an upstream server, passing every message
+// through the pipeline of its direction
+type Proxy struct {
+	Upstreams      *UpstreamPool
+	ClientToServer Pipeline
+	ServerToClient Pipeline
+	// Record every session to a file in here, see Capture
+	CaptureDir string
+}
+
+// Accepts connections until the listener fails
+func (p *Proxy) Serve(listen net.Listener) error {
+	for {
+		conn, err := listen.Accept()
+		if err != nil {
+			return err
+		}
+		log.Println("Got Connection")
+
+		go p.handleConnection(conn)
+	}
+}
+
+func (p *Proxy) handleConnection(clientConn net.Conn) {
+	defer clientConn.Close()
+
+	// Establish connection to the real server
+	serverConn, upstream, err := p.Upstreams.Dial()
+	if err != nil {
+		// Only this client is affected, everyone else keeps going
+		log.Println("Giving up on client: ", err)
+		clientConn.Write([]byte(UpstreamUnavailableMessage))
+		return
+	}
+	defer serverConn.Close()
+	log.Printf("Forwarding to %s", upstream.Addr)
+
+	var capture *Capture
+	if p.CaptureDir != "" {
+		capture, err = NewCapture(p.CaptureDir, clientConn.RemoteAddr())
+		if err != nil {
+			log.Println("Not capturing session: ", err)
+		}
+		defer capture.Close()
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		err := relay(clientConn, serverConn, p.ClientToServer, ClientToServer, capture)
+		finishRelay(err, ClientToServer, clientConn, serverConn)
+	}()
+	go func() {
+		defer wg.Done()
+		err := relay(serverConn, clientConn, p.ServerToClient, ServerToClient, capture)
+		finishRelay(err, ServerToClient, serverConn, clientConn)
+	}()
+	wg.Wait()
+}
+
+// Once src is done sending only the write side of dst gets shut, so
+// whatever is still coming the other way gets through. Anything but a clean
+// end of stream ends the whole session.
+func finishRelay(err error, direction Direction, src net.Conn, dst net.Conn) {
+	if err == io.EOF {
+		if halfCloser, ok := dst.(interface{ CloseWrite() error }); ok && halfCloser.CloseWrite() == nil {
+			return
+		}
+	} else if !errors.Is(err, net.ErrClosed) {
+		log.Printf("%s: %v", direction, err)
+	}
+	src.Close()
+	dst.Close()
+}
+
+// Copies frames going in direction from src to dst until either of them
+// fails. Pieces of frames, be it the start of an overly long one or what
+// was left when src hung up, are passed on as they are. Returns io.EOF
+// once src is done.
+func relay(src net.Conn, dst net.Conn, pipeline Pipeline, direction Direction, capture *Capture) error {
+	reader := bufio.NewReader(src)
+	// In the middle of a frame that is too long to transform
+	streaming := false
+	for {
+		frame, err := pipeline.Framer.ReadFrame(reader)
+		if len(frame) == 0 && err != nil {
+			return err
+		}
+
+		var original []byte
+		if capture != nil {
+			// Transformers may change frames in place
+			original = append(original, frame...)
+		}
+		passthrough := true
+		switch {
+		case err == ErrFrameTooLong:
+			streaming = true
+		case err != nil:
+			// Incomplete frame at the end of the stream
+		case streaming:
+			// Last piece of a long frame
+			streaming = false
+		default:
+			frame = pipeline.transform(frame)
+			passthrough = false
+		}
+		capture.Record(direction, original, frame, passthrough)
+
+		if frame != nil {
+			if _, err := dst.Write(frame); err != nil {
+				return err
+			}
+		}
+		if err == io.ErrUnexpectedEOF {
+			return io.EOF
+		}
+		if err != nil && err != ErrFrameTooLong {
+			return err
+		}
+	}
+}
@@ -0,0 +1,283 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newChatProxy(t *testing.T, upstreams *UpstreamPool) *Proxy {
+	proxy, err := NewProtocolProxy("chat", upstreams, NewRuleEngine(DefaultRules()), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return proxy
+}
+
+// Starts proxy in front of upstreamAddr and connects to it
+func dialThroughProxy(t *testing.T, proxy *Proxy, upstreamAddr string) net.Conn {
+	proxy.Upstreams = &UpstreamPool{Upstreams: []Upstream{{Addr: upstreamAddr}}}
+	listen, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listen.Close() })
+	go proxy.Serve(listen)
+
+	conn, err := net.Dial("tcp", listen.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	return conn
+}
+
+func TestFramers(t *testing.T) {
+	type test struct {
+		Name     string
+		Framer   Framer
+		Input    string
+		Expected []string
+		// Error after the expected frames
+		Error string
+		// Returned together with Error
+		Rest string
+	}
+	testCases := []test{
+		{Name: "lines", Framer: LineFramer{MaxLength: 10}, Input: "one\ntwo\n", Expected: []string{"one\n", "two\n"}, Error: "EOF"},
+		// Only lines that don't fit into bufio's buffer get split up
+		{Name: "long line", Framer: LineFramer{MaxLength: 10}, Input: "short\nlonger than ten\n", Expected: []string{"short\n", "longer than ten\n"}, Error: "EOF"},
+		{Name: "unterminated line", Framer: LineFramer{MaxLength: 10}, Input: "one\ntw", Expected: []string{"one\n"}, Error: "EOF", Rest: "tw"},
+		// Lines longer than bufio's buffer
+		{Name: "huge line", Framer: LineFramer{}, Input: strings.Repeat("x", 10000) + "\n", Expected: []string{strings.Repeat("x", 10000) + "\n"}, Error: "EOF"},
+		{Name: "fixed", Framer: FixedFramer{Size: 3}, Input: "abcdefgh", Expected: []string{"abc", "def"}, Error: "unexpected EOF", Rest: "gh"},
+		{Name: "chunks", Framer: ChunkFramer{}, Input: "anything\x00goes", Expected: []string{"anything\x00goes"}, Error: "EOF"},
+	}
+
+	for _, tc := range testCases {
+		reader := bufio.NewReader(strings.NewReader(tc.Input))
+		for i, expected := range tc.Expected {
+			frame, err := tc.Framer.ReadFrame(reader)
+			if err != nil || string(frame) != expected {
+				t.Errorf("%s, frame %d: expected: %q, got: %q (%v)", tc.Name, i, expected, frame, err)
+			}
+		}
+		if rest, err := tc.Framer.ReadFrame(reader); err == nil || err.Error() != tc.Error || string(rest) != tc.Rest {
+			t.Errorf("%s: expected %q with error %q, got %q (%v)", tc.Name, tc.Rest, tc.Error, rest, err)
+		}
+	}
+}
+
+// Both ends of a fresh TCP connection
+func tcpPair(t *testing.T) (*net.TCPConn, *net.TCPConn) {
+	listen, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listen.Close()
+	client, err := net.Dial("tcp", listen.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err := listen.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		client.Close()
+		server.Close()
+	})
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+	server.SetDeadline(time.Now().Add(5 * time.Second))
+	return client.(*net.TCPConn), server.(*net.TCPConn)
+}
+
+func TestRelay(t *testing.T) {
+	type test struct {
+		Name     string
+		Input    string
+		Expected string
+		// Of every recorded frame
+		Passthrough []bool
+	}
+	long := strings.Repeat("x", 5000) + "\n"
+	testCases := []test{
+		{Name: "lines", Input: "one\ntwo\n", Expected: "ONE\nTWO\n", Passthrough: []bool{false, false}},
+		{Name: "unterminated tail", Input: "one\ntw", Expected: "ONE\ntw", Passthrough: []bool{false, true}},
+		// bufio's buffer holds 4096 bytes, the rest comes as the last piece
+		{Name: "long line", Input: long + "short\n", Expected: long + "SHORT\n", Passthrough: []bool{true, true, false}},
+	}
+	pipeline := Pipeline{
+		Framer:      LineFramer{MaxLength: 10},
+		Transformer: TransformerFunc(func(frame []byte) []byte { return []byte(strings.ToUpper(string(frame))) }),
+	}
+
+	for _, tc := range testCases {
+		client, proxyClient := tcpPair(t)
+		proxyServer, server := tcpPair(t)
+		dir := t.TempDir()
+		capture, err := NewCapture(dir, client.LocalAddr())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		relayed := make(chan error, 1)
+		go func() {
+			err := relay(proxyClient, proxyServer, pipeline, ClientToServer, capture)
+			finishRelay(err, ClientToServer, proxyClient, proxyServer)
+			relayed <- err
+		}()
+		client.Write([]byte(tc.Input))
+		client.CloseWrite()
+
+		// The server sees everything, then the client's half close
+		got, err := io.ReadAll(server)
+		if err != nil || string(got) != tc.Expected {
+			t.Errorf("%s: expected %q, got %q (%v)", tc.Name, tc.Expected, got, err)
+		}
+		if err := <-relayed; err != io.EOF {
+			t.Errorf("%s: expected relay to end with EOF, got %v", tc.Name, err)
+		}
+		// The other direction keeps going
+		server.Write([]byte("reply\n"))
+		reply, err := bufio.NewReader(proxyServer).ReadString('\n')
+		if err != nil || reply != "reply\n" {
+			t.Errorf("%s: can't read from the server any more: %q (%v)", tc.Name, reply, err)
+		}
+		proxyClient.Write([]byte(reply))
+		reply, err = bufio.NewReader(client).ReadString('\n')
+		if err != nil || reply != "reply\n" {
+			t.Errorf("%s: can't write to the client any more: %q (%v)", tc.Name, reply, err)
+		}
+
+		capture.Close()
+		files, _ := filepath.Glob(filepath.Join(dir, "*.jsonl"))
+		if len(files) != 1 {
+			t.Fatalf("%s: expected one capture file, got %v", tc.Name, files)
+		}
+		records, err := ReadCapture(files[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		var passthrough []bool
+		for _, record := range records {
+			passthrough = append(passthrough, record.Passthrough)
+		}
+		if fmt.Sprint(passthrough) != fmt.Sprint(tc.Passthrough) {
+			t.Errorf("%s: expected passthrough %v, got %v", tc.Name, tc.Passthrough, passthrough)
+		}
+	}
+}
+
+// Tiny MeansToAnEnd server: remembers inserted prices, answers queries
+// with the mean of all of them
+func startMeansUpstream(t *testing.T) string {
+	listen, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listen.Close() })
+	go func() {
+		conn, err := listen.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		var sum, count int64
+		request := make([]byte, 9)
+		for {
+			if _, err := io.ReadFull(conn, request); err != nil {
+				return
+			}
+			switch request[0] {
+			case 'I':
+				sum += int64(int32(binary.BigEndian.Uint32(request[5:])))
+				count++
+			case 'Q':
+				response := make([]byte, 4)
+				if count > 0 {
+					binary.BigEndian.PutUint32(response, uint32(int32(sum/count)))
+				}
+				conn.Write(response)
+			}
+		}
+	}()
+	return listen.Addr().String()
+}
+
+func meansRequest(kind byte, first int32, second int32) []byte {
+	request := []byte{kind, 0, 0, 0, 0, 0, 0, 0, 0}
+	binary.BigEndian.PutUint32(request[1:5], uint32(first))
+	binary.BigEndian.PutUint32(request[5:9], uint32(second))
+	return request
+}
+
+func TestBinaryProtocolRewrite(t *testing.T) {
+	proxy, err := NewProtocolProxy("means", nil, nil, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Everything the client inserts gets more expensive
+	proxy.ClientToServer.Transformer = TransformerFunc(func(frame []byte) []byte {
+		if frame[0] == 'I' {
+			price := int32(binary.BigEndian.Uint32(frame[5:]))
+			binary.BigEndian.PutUint32(frame[5:], uint32(price*2))
+		}
+		return frame
+	})
+	conn := dialThroughProxy(t, proxy, startMeansUpstream(t))
+
+	// Requests split at odd places still arrive as whole frames
+	var stream []byte
+	stream = append(stream, meansRequest('I', 1, 100)...)
+	stream = append(stream, meansRequest('I', 2, 200)...)
+	stream = append(stream, meansRequest('Q', 0, 10)...)
+	for len(stream) > 0 {
+		n := 5
+		if n > len(stream) {
+			n = len(stream)
+		}
+		conn.Write(stream[:n])
+		stream = stream[n:]
+	}
+
+	response := make([]byte, 4)
+	if _, err := io.ReadFull(conn, response); err != nil {
+		t.Fatal(err)
+	}
+	if mean := int32(binary.BigEndian.Uint32(response)); mean != 300 {
+		t.Errorf("expected mean of doubled prices 300, got %d", mean)
+	}
+}
+
+func TestDescribeFrames(t *testing.T) {
+	type test struct {
+		Describe func([]byte) string
+		Frame    []byte
+		Expected string
+	}
+	testCases := []test{
+		{Describe: describeJSON, Frame: []byte("{\"method\": \"isPrime\",  \"number\": 7}\n"), Expected: `{"method":"isPrime","number":7}`},
+		{Describe: describeJSON, Frame: []byte("{nope\n"), Expected: `invalid JSON "{nope\n"`},
+		{Describe: describeMeansToAnEndRequest, Frame: meansRequest('I', 12345, 101), Expected: "insert timestamp=12345 price=101"},
+		{Describe: describeMeansToAnEndRequest, Frame: meansRequest('Q', -5, 1000), Expected: "query mintime=-5 maxtime=1000"},
+		{Describe: describeMeansToAnEndRequest, Frame: meansRequest('X', 0, 0), Expected: "unknown request 580000000000000000"},
+		{Describe: describeMeansToAnEndResponse, Frame: []byte{0, 0, 0, 101}, Expected: "mean=101"},
+	}
+	for _, tc := range testCases {
+		if got := tc.Describe(tc.Frame); got != tc.Expected {
+			t.Errorf("Frame: %q, expected: %q, got: %q", tc.Frame, tc.Expected, got)
+		}
+	}
+
+	if _, err := NewProtocolProxy("carrier-pigeon", nil, nil, false); err == nil {
+		t.Error("Unknown protocols should be refused")
+	}
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Which way a message travels through the proxy
+type Direction int
+
+const (
+	ClientToServer Direction = 1 << iota
+	ServerToClient
+	BothDirections = ClientToServer | ServerToClient
+)
+
+func ParseDirection(s string) (Direction, error) {
+	switch s {
+	case "", "both":
+		return BothDirections, nil
+	case "client-to-server":
+		return ClientToServer, nil
+	case "server-to-client":
+		return ServerToClient, nil
+	}
+	return 0, fmt.Errorf("unknown direction %q (want client-to-server, server-to-client or both)", s)
+}
+
+// How a rule appears in the config file, e.g.
+//
+//	{"name": "boguscoin", "pattern": "7[[:alnum:]]{25,34}", "replace": "7YWHMfk9JZe0LM0g1ZauHuiSxhI"}
+type RuleConfig struct {
+	Name    string `json:"name"`
+	Pattern string `json:"pattern"`
+	// Replacement, may refer to capture groups as $1 or ${name}
+	Replace string `json:"replace"`
+	// "client-to-server", "server-to-client" or "both" (default)
+	Direction string `json:"direction"`
+	// "token" (default) only replaces whole space separated words that
+	// match pattern completely, "substring" replaces matches anywhere
+	Match string `json:"match"`
+}
+
+type RulesConfig struct {
+	Rules []RuleConfig `json:"rules"`
+}
+
+// A compiled rewrite rule
+type Rule struct {
+	Name      string
+	Pattern   *regexp.Regexp
+	Replace   string
+	Direction Direction
+	// Only whole tokens are matched, Pattern is anchored to the token
+	Token bool
+}
+
+func CompileRule(config RuleConfig) (Rule, error) {
+	rule := Rule{Name: config.Name, Replace: config.Replace}
+
+	var err error
+	rule.Direction, err = ParseDirection(config.Direction)
+	if err != nil {
+		return rule, err
+	}
+
+	pattern := config.Pattern
+	switch config.Match {
+	case "", "token":
+		rule.Token = true
+		pattern = `^(?:` + pattern + `)$`
+	case "substring":
+	default:
+		return rule, fmt.Errorf("unknown match %q (want token or substring)", config.Match)
+	}
+	rule.Pattern, err = regexp.Compile(pattern)
+	return rule, err
+}
+
+// Rewrites line, which is a single message without its newline
+func (r Rule) Apply(line string) string {
+	if !r.Token {
+		return r.Pattern.ReplaceAllString(line, r.Replace)
+	}
+
+	tokens := strings.Split(line, " ")
+	for i, token := range tokens {
+		if r.Pattern.MatchString(token) {
+			tokens[i] = r.Pattern.ReplaceAllString(token, r.Replace)
+		}
+	}
+	return strings.Join(tokens, " ")
+}
+
+// Rules applied one after the other, each sees the output of the last one
+type RuleSet []Rule
+
+func CompileRules(config RulesConfig) (RuleSet, error) {
+	var rules RuleSet
+	for i, ruleConfig := range config.Rules {
+		rule, err := CompileRule(ruleConfig)
+		if err != nil {
+			name := ruleConfig.Name
+			if name == "" {
+				name = fmt.Sprintf("#%d", i+1)
+			}
+			return nil, fmt.Errorf("rule %s: %w", name, err)
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+func LoadRules(path string) (RuleSet, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var config RulesConfig
+	if err := json.Unmarshal(content, &config); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return CompileRules(config)
+}
+
+// What the proxy does without a config file: steal every Boguscoin payment
+func DefaultRules() RuleSet {
+	rules, err := CompileRules(RulesConfig{Rules: []RuleConfig{{
+		Name:    "boguscoin",
+		Pattern: BoguscoinPattern,
+		Replace: FakeBogusCoinAddress,
+	}}})
+	if err != nil {
+		panic(err)
+	}
+	return rules
+}
+
+// Rewrites a message going in direction. The trailing newline, if any, is
+// kept out of the rules' way.
+func (rules RuleSet) Apply(msg string, direction Direction) string {
+	line := strings.TrimSuffix(msg, "\n")
+	for _, rule := range rules {
+		if rule.Direction&direction != 0 {
+			line = rule.Apply(line)
+		}
+	}
+	if strings.HasSuffix(msg, "\n") {
+		line += "\n"
+	}
+	return line
+}
+
+// The rules currently in use. They can be swapped out at any time without
+// disturbing connections that are in the middle of applying them.
+type RuleEngine struct {
+	rules atomic.Value
+	path  string
+
+	// Keeps reloads from SIGHUP and Watch from overlapping
+	reloadMu sync.Mutex
+	// Modification time of path when it was last loaded
+	modTime time.Time
+}
+
+func NewRuleEngine(rules RuleSet) *RuleEngine {
+	engine := &RuleEngine{}
+	engine.rules.Store(rules)
+	return engine
+}
+
+// Loads the rules from path, Reload and Watch read it again later
+func LoadRuleEngine(path string) (*RuleEngine, error) {
+	engine := &RuleEngine{path: path}
+	if err := engine.Reload(); err != nil {
+		return nil, err
+	}
+	return engine, nil
+}
+
+func (e *RuleEngine) Rules() RuleSet {
+	return e.rules.Load().(RuleSet)
+}
+
+func (e *RuleEngine) Apply(msg string, direction Direction) string {
+	return e.Rules().Apply(msg, direction)
+}
+
+// Reads the config file again. A broken file leaves the current rules in place.
+func (e *RuleEngine) Reload() error {
+	e.reloadMu.Lock()
+	defer e.reloadMu.Unlock()
+	return e.reload()
+}
+
+func (e *RuleEngine) reload() error {
+	info, err := os.Stat(e.path)
+	if err != nil {
+		return err
+	}
+	rules, err := LoadRules(e.path)
+	if err != nil {
+		return err
+	}
+	e.rules.Store(rules)
+	e.modTime = info.ModTime()
+	log.Printf("Loaded %d rules from %s", len(rules), e.path)
+	return nil
+}
+
+// Reloads the config file whenever it changes, checking every interval.
+// Never returns.
+func (e *RuleEngine) Watch(interval time.Duration) {
+	for range time.Tick(interval) {
+		e.reloadIfChanged()
+	}
+}
+
+func (e *RuleEngine) reloadIfChanged() {
+	e.reloadMu.Lock()
+	defer e.reloadMu.Unlock()
+
+	info, err := os.Stat(e.path)
+	if err != nil || info.ModTime().Equal(e.modTime) {
+		return
+	}
+	if err := e.reload(); err != nil {
+		log.Println("Keeping old rules: ", err)
+		// Don't complain again until the file changes
+		e.modTime = info.ModTime()
+	}
+}
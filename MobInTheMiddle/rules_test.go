@@ -0,0 +1,135 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestDefaultRules(t *testing.T) {
+	type test struct {
+		Msg      string
+		Expected string
+	}
+
+	tony := FakeBogusCoinAddress
+	testCases := []test{
+		{Msg: "Hi alice, please send payment to 7iKDZEwPZSqIvDnHvVN2r0hUWXD5rHX\n", Expected: "Hi alice, please send payment to " + tony + "\n"},
+		{Msg: "7F1u3wSD5RbOHQmupo9nx4TnhQ is mine\n", Expected: tony + " is mine\n"},
+		{Msg: "two 7LOrwbDlS8NujgjddyogWgIM93MV5N2VR 7adNeSwJkMakpEcln9HEtthSRtxdmEHOT8T\n", Expected: "two " + tony + " " + tony + "\n"},
+		// Too short, too long, not starting with 7 or glued to other characters
+		{Msg: "7abc\n", Expected: "7abc\n"},
+		{Msg: "7iKDZEwPZSqIvDnHvVN2r0hUWXD5rHXAAAAAAAAAAAAAAAAAAAAAA\n", Expected: "7iKDZEwPZSqIvDnHvVN2r0hUWXD5rHXAAAAAAAAAAAAAAAAAAAAAA\n"},
+		{Msg: "8iKDZEwPZSqIvDnHvVN2r0hUWXD5rHX\n", Expected: "8iKDZEwPZSqIvDnHvVN2r0hUWXD5rHX\n"},
+		{Msg: "7iKDZEwPZSqIvDnHvVN2r0hUWXD5rHX-1234\n", Expected: "7iKDZEwPZSqIvDnHvVN2r0hUWXD5rHX-1234\n"},
+		// Spaces are kept as they were
+		{Msg: "  7iKDZEwPZSqIvDnHvVN2r0hUWXD5rHX  \n", Expected: "  " + tony + "  \n"},
+		{Msg: "no newline 7iKDZEwPZSqIvDnHvVN2r0hUWXD5rHX", Expected: "no newline " + tony},
+	}
+
+	rules := DefaultRules()
+	for _, tc := range testCases {
+		for _, direction := range []Direction{ClientToServer, ServerToClient} {
+			if got := rules.Apply(tc.Msg, direction); got != tc.Expected {
+				t.Errorf("Msg: %q, expected: %q, got: %q", tc.Msg, tc.Expected, got)
+			}
+		}
+	}
+}
+
+func TestRuleOptions(t *testing.T) {
+	rules, err := CompileRules(RulesConfig{Rules: []RuleConfig{
+		{Name: "upper", Pattern: `hello`, Replace: "HELLO", Direction: "client-to-server", Match: "substring"},
+		{Name: "swap", Pattern: `(\w+)@(\w+)`, Replace: "${2}@${1}", Direction: "server-to-client"},
+		{Name: "price", Pattern: `(?P<amount>\d+)coins`, Replace: "${amount}0coins", Match: "substring"},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	type test struct {
+		Msg       string
+		Direction Direction
+		Expected  string
+	}
+	testCases := []test{
+		{Msg: "hello othello\n", Direction: ClientToServer, Expected: "HELLO otHELLO\n"},
+		{Msg: "hello othello\n", Direction: ServerToClient, Expected: "hello othello\n"},
+		{Msg: "mail bob@home\n", Direction: ServerToClient, Expected: "mail home@bob\n"},
+		{Msg: "mail bob@home\n", Direction: ClientToServer, Expected: "mail bob@home\n"},
+		// Tokens have to match completely
+		{Msg: "mail bob@home!\n", Direction: ServerToClient, Expected: "mail bob@home!\n"},
+		{Msg: "pay 5coins, 7coins\n", Direction: ClientToServer, Expected: "pay 50coins, 70coins\n"},
+	}
+	for _, tc := range testCases {
+		if got := rules.Apply(tc.Msg, tc.Direction); got != tc.Expected {
+			t.Errorf("Msg: %q, Direction: %d, expected: %q, got: %q", tc.Msg, tc.Direction, tc.Expected, got)
+		}
+	}
+}
+
+func TestBrokenRules(t *testing.T) {
+	broken := []RuleConfig{
+		{Pattern: `(unclosed`},
+		{Pattern: `x`, Direction: "sideways"},
+		{Pattern: `x`, Match: "fuzzy"},
+	}
+	for _, rule := range broken {
+		if _, err := CompileRules(RulesConfig{Rules: []RuleConfig{rule}}); err == nil {
+			t.Errorf("%+v should be refused", rule)
+		}
+	}
+}
+
+func TestRulesHotReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "rules.json")
+	write := func(content string, modTime time.Time) {
+		t.Helper()
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		// File systems with coarse timestamps would hide a quick change
+		if err := os.Chtimes(path, modTime, modTime); err != nil {
+			t.Fatal(err)
+		}
+	}
+	start := time.Now().Add(-time.Hour)
+
+	write(`{"rules": [{"pattern": "cat", "replace": "dog"}]}`, start)
+	engine, err := LoadRuleEngine(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := engine.Apply("cat\n", ClientToServer); got != "dog\n" {
+		t.Errorf("expected dog, got %q", got)
+	}
+
+	// Unchanged files are left alone
+	engine.reloadIfChanged()
+	write(`{"rules": [{"pattern": "cat", "replace": "mouse"}]}`, start.Add(time.Minute))
+	engine.reloadIfChanged()
+	if got := engine.Apply("cat\n", ClientToServer); got != "mouse\n" {
+		t.Errorf("expected mouse after reload, got %q", got)
+	}
+
+	// A broken file keeps the old rules around
+	write(`{"rules": [{"pattern": "(cat", "replace": "bird"}]}`, start.Add(2*time.Minute))
+	engine.reloadIfChanged()
+	if err := engine.Reload(); err == nil {
+		t.Error("Reloading a broken file should fail")
+	}
+	if got := engine.Apply("cat\n", ClientToServer); got != "mouse\n" {
+		t.Errorf("expected the old rules to stay, got %q", got)
+	}
+}
+
+func TestExampleRules(t *testing.T) {
+	rules, err := LoadRules("rules.example.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := rules.Apply("Hello, pay 7iKDZEwPZSqIvDnHvVN2r0hUWXD5rHX\n", ClientToServer); got != "hi, pay "+FakeBogusCoinAddress+"\n" {
+		t.Errorf("unexpected rewrite: %q", got)
+	}
+}
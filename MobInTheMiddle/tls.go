@@ -0,0 +1,58 @@
+package main
+
+import (
+	"crypto/tls"
+	"flag"
+
+	"lightstack.ml/tlsutil"
+)
+
+// How the proxy talks TLS to the upstream server
+type UpstreamTLSOptions struct {
+	Enabled bool
+	// Verify the upstream against this CA instead of the system roots
+	CAFile string
+	// Client certificate to present to the upstream
+	CertFile string
+	KeyFile  string
+	// Skip certificate verification (development only)
+	Insecure bool
+}
+
+func RegisterUpstreamTLSFlags() *UpstreamTLSOptions {
+	options := &UpstreamTLSOptions{}
+	flag.BoolVar(&options.Enabled, "upstream-tls", false, "connect to the upstream server with TLS")
+	flag.StringVar(&options.CAFile, "upstream-tls-ca", "", "PEM CA to verify the upstream server with")
+	flag.StringVar(&options.CertFile, "upstream-tls-cert", "", "PEM client certificate for the upstream server")
+	flag.StringVar(&options.KeyFile, "upstream-tls-key", "", "PEM private key of the upstream client certificate")
+	flag.BoolVar(&options.Insecure, "upstream-tls-insecure", false, "don't verify the upstream certificate (development only)")
+	return options
+}
+
+// Builds the client side TLS config for serverName, nil if TLS is off
+func (o *UpstreamTLSOptions) ClientConfig(serverName string) (*tls.Config, error) {
+	if !o.Enabled {
+		return nil, nil
+	}
+
+	config := &tls.Config{
+		ServerName:         serverName,
+		InsecureSkipVerify: o.Insecure,
+		MinVersion:         tls.VersionTLS12,
+	}
+	if o.CAFile != "" {
+		pool, err := tlsutil.LoadCertPool(o.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = pool
+	}
+	if o.CertFile != "" || o.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(o.CertFile, o.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config, nil
+}
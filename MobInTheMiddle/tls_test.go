@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"crypto/x509"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"lightstack.ml/tlsutil"
+)
+
+// In-memory CA with a server and a client certificate signed by it
+type testPKI struct {
+	dir        string
+	roots      *x509.CertPool
+	clientCert tls.Certificate
+	options    tlsutil.Options
+}
+
+func newTestPKI(t *testing.T) testPKI {
+	ca, err := tlsutil.GenerateSelfSignedCert([]string{"Test CA"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverCert, err := tlsutil.GenerateCert([]string{"localhost", "127.0.0.1"}, &ca)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientCert, err := tlsutil.GenerateCert([]string{"client"}, &ca)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	pki := testPKI{
+		dir:        dir,
+		roots:      x509.NewCertPool(),
+		clientCert: clientCert,
+		options: tlsutil.Options{
+			CertFile:     filepath.Join(dir, "server.pem"),
+			KeyFile:      filepath.Join(dir, "server.key"),
+			ClientCAFile: filepath.Join(dir, "ca.pem"),
+		},
+	}
+	caCert, _ := x509.ParseCertificate(ca.Certificate[0])
+	pki.roots.AddCert(caCert)
+
+	if err := tlsutil.WriteCertificate(serverCert, pki.options.CertFile, pki.options.KeyFile); err != nil {
+		t.Fatal(err)
+	}
+	if err := tlsutil.WriteCertificate(ca, pki.options.ClientCAFile, filepath.Join(dir, "ca.key")); err != nil {
+		t.Fatal(err)
+	}
+	return pki
+}
+
+// Fake chat server that only accepts the proxy's client certificate and
+// echoes every line back
+func startTLSEchoUpstream(t *testing.T, options tlsutil.Options) string {
+	config, err := options.ServerConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	listen, err := tlsutil.Listen("tcp", "127.0.0.1:0", config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listen.Close() })
+
+	go func() {
+		for {
+			conn, err := listen.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				reader := bufio.NewReader(conn)
+				for {
+					line, err := reader.ReadString('\n')
+					if err != nil {
+						return
+					}
+					conn.Write([]byte(line))
+				}
+			}()
+		}
+	}()
+	return listen.Addr().String()
+}
+
+func TestProxyTLSBothWays(t *testing.T) {
+	pki := newTestPKI(t)
+	upstreamAddr := startTLSEchoUpstream(t, pki.options)
+
+	// The proxy presents the client certificate to the upstream
+	upstreamOptions := UpstreamTLSOptions{
+		Enabled:  true,
+		CAFile:   pki.options.ClientCAFile,
+		CertFile: filepath.Join(pki.dir, "proxy.pem"),
+		KeyFile:  filepath.Join(pki.dir, "proxy.key"),
+	}
+	if err := tlsutil.WriteCertificate(pki.clientCert, upstreamOptions.CertFile, upstreamOptions.KeyFile); err != nil {
+		t.Fatal(err)
+	}
+	upstreamTLS, err := upstreamOptions.ClientConfig("localhost")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Clients don't need a certificate to talk to the proxy
+	downstreamOptions := pki.options
+	downstreamOptions.ClientCAFile = ""
+	downstreamTLS, err := downstreamOptions.ServerConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	listen, err := tlsutil.Listen("tcp", "127.0.0.1:0", downstreamTLS)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listen.Close()
+	go newChatProxy(t, &UpstreamPool{Upstreams: []Upstream{{Addr: upstreamAddr, TLS: upstreamTLS}}}).Serve(listen)
+
+	conn, err := tls.Dial("tcp", listen.Addr().String(), &tls.Config{RootCAs: pki.roots})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	conn.Write([]byte("send it to 7F1u3wSD5RbOHQmupo9nx4TnhQ please\n"))
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	if line != "send it to "+FakeBogusCoinAddress+" please\n" {
+		t.Errorf("unexpected line from proxy: %q", line)
+	}
+}
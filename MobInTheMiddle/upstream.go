@@ -0,0 +1,110 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// A real chat server the proxy can forward to
+type Upstream struct {
+	Addr string
+	// Talk TLS to the upstream if set
+	TLS *tls.Config
+}
+
+func (u Upstream) Dial(timeout time.Duration) (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: timeout}
+	if u.TLS != nil {
+		return tls.DialWithDialer(dialer, "tcp", u.Addr, u.TLS)
+	}
+	return dialer.Dial("tcp", u.Addr)
+}
+
+// How the pool picks an upstream for a new connection
+type SelectionStrategy int
+
+const (
+	// Always the first upstream that answers, in the order given
+	Failover SelectionStrategy = iota
+	// Take turns, skipping upstreams that don't answer
+	RoundRobin
+)
+
+func ParseSelectionStrategy(s string) (SelectionStrategy, error) {
+	switch s {
+	case "failover":
+		return Failover, nil
+	case "round-robin":
+		return RoundRobin, nil
+	}
+	return 0, errors.New("unknown upstream strategy (want failover or round-robin)")
+}
+
+// Every upstream the proxy may forward to
+type UpstreamPool struct {
+	Upstreams []Upstream
+	Strategy  SelectionStrategy
+	// How long one connection attempt may take, 0 leaves it to the OS
+	ConnectTimeout time.Duration
+	// How often to go through the whole list again if nobody answered
+	Retries    int
+	RetryDelay time.Duration
+
+	// Where round robin starts next
+	next uint32
+}
+
+// Builds one Upstream per address, each with tlsConfig set up for its host
+func ParseUpstreams(addrs string, tlsConfig *tls.Config) ([]Upstream, error) {
+	var upstreams []Upstream
+	for _, addr := range strings.Split(addrs, ",") {
+		addr = strings.TrimSpace(addr)
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, err
+		}
+		upstream := Upstream{Addr: addr}
+		if tlsConfig != nil {
+			upstream.TLS = tlsConfig.Clone()
+			upstream.TLS.ServerName = host
+		}
+		upstreams = append(upstreams, upstream)
+	}
+	return upstreams, nil
+}
+
+// Connects to an upstream according to the strategy, returns the error of
+// the last attempt if none of them answered
+func (p *UpstreamPool) Dial() (net.Conn, Upstream, error) {
+	if len(p.Upstreams) == 0 {
+		return nil, Upstream{}, errors.New("no upstreams configured")
+	}
+
+	start := 0
+	if p.Strategy == RoundRobin {
+		start = int((atomic.AddUint32(&p.next, 1) - 1) % uint32(len(p.Upstreams)))
+	}
+
+	var lastErr error
+	for attempt := 0; attempt <= p.Retries; attempt++ {
+		if attempt > 0 {
+			time.Sleep(p.RetryDelay)
+		}
+		for i := range p.Upstreams {
+			upstream := p.Upstreams[(start+i)%len(p.Upstreams)]
+			conn, err := upstream.Dial(p.ConnectTimeout)
+			if err == nil {
+				return conn, upstream, nil
+			}
+			log.Printf("Can't reach upstream %s: %v", upstream.Addr, err)
+			lastErr = err
+		}
+	}
+	return nil, Upstream{}, fmt.Errorf("no upstream answered: %w", lastErr)
+}
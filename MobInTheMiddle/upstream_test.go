@@ -0,0 +1,165 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// Upstream that greets every connection with its name
+func startNamedUpstream(t *testing.T, name string) string {
+	listen, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listen.Close() })
+	go func() {
+		for {
+			conn, err := listen.Accept()
+			if err != nil {
+				return
+			}
+			fmt.Fprintf(conn, "%s\n", name)
+			conn.Close()
+		}
+	}()
+	return listen.Addr().String()
+}
+
+// Address nobody listens on
+func deadAddr(t *testing.T) string {
+	listen, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := listen.Addr().String()
+	listen.Close()
+	return addr
+}
+
+func dialName(t *testing.T, pool *UpstreamPool) string {
+	t.Helper()
+	conn, _, err := pool.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	name, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	return name[:len(name)-1]
+}
+
+func TestUpstreamSelection(t *testing.T) {
+	first := Upstream{Addr: startNamedUpstream(t, "first")}
+	second := Upstream{Addr: startNamedUpstream(t, "second")}
+	dead := Upstream{Addr: deadAddr(t)}
+
+	type test struct {
+		Name      string
+		Upstreams []Upstream
+		Strategy  SelectionStrategy
+		Expected  []string
+	}
+	testCases := []test{
+		{Name: "failover", Upstreams: []Upstream{first, second}, Strategy: Failover, Expected: []string{"first", "first", "first"}},
+		{Name: "failover skips dead", Upstreams: []Upstream{dead, second, first}, Strategy: Failover, Expected: []string{"second", "second"}},
+		{Name: "round robin", Upstreams: []Upstream{first, second}, Strategy: RoundRobin, Expected: []string{"first", "second", "first", "second"}},
+		{Name: "round robin skips dead", Upstreams: []Upstream{first, dead, second}, Strategy: RoundRobin, Expected: []string{"first", "second", "second", "first"}},
+	}
+
+	for _, tc := range testCases {
+		pool := &UpstreamPool{Upstreams: tc.Upstreams, Strategy: tc.Strategy, ConnectTimeout: time.Second}
+		for i, expected := range tc.Expected {
+			if got := dialName(t, pool); got != expected {
+				t.Errorf("%s, connection %d: expected: %s, got: %s", tc.Name, i, expected, got)
+			}
+		}
+	}
+}
+
+func TestUpstreamRetries(t *testing.T) {
+	addr := deadAddr(t)
+	pool := &UpstreamPool{
+		Upstreams:  []Upstream{{Addr: addr}},
+		Retries:    20,
+		RetryDelay: 50 * time.Millisecond,
+	}
+
+	// The upstream comes up while the proxy is still retrying
+	go func() {
+		time.Sleep(120 * time.Millisecond)
+		listen, err := net.Listen("tcp", addr)
+		if err != nil {
+			return
+		}
+		t.Cleanup(func() { listen.Close() })
+		conn, err := listen.Accept()
+		if err == nil {
+			fmt.Fprint(conn, "late\n")
+			conn.Close()
+		}
+	}()
+	if got := dialName(t, pool); got != "late" {
+		t.Errorf("expected late, got %s", got)
+	}
+
+	pool = &UpstreamPool{Upstreams: []Upstream{{Addr: deadAddr(t)}}, Retries: 2}
+	if _, _, err := pool.Dial(); err == nil {
+		t.Error("Dialing a dead upstream should fail")
+	}
+	if _, _, err := (&UpstreamPool{}).Dial(); err == nil {
+		t.Error("Dialing without upstreams should fail")
+	}
+}
+
+func TestConnectTimeout(t *testing.T) {
+	// Nothing routes to TEST-NET-1, depending on the network this either
+	// times out or fails right away
+	pool := &UpstreamPool{Upstreams: []Upstream{{Addr: "192.0.2.1:16963"}}, ConnectTimeout: 100 * time.Millisecond}
+	start := time.Now()
+	if _, _, err := pool.Dial(); err == nil {
+		t.Fatal("Connecting to TEST-NET-1 should fail")
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("Connect timeout ignored, took %s", elapsed)
+	}
+}
+
+func TestUnreachableUpstreamKeepsProxyRunning(t *testing.T) {
+	listen, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listen.Close()
+	pool := &UpstreamPool{Upstreams: []Upstream{{Addr: deadAddr(t)}}}
+	go newChatProxy(t, pool).Serve(listen)
+
+	// Every client gets told politely, the proxy doesn't die on the first one
+	for i := 0; i < 2; i++ {
+		conn, err := net.Dial("tcp", listen.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		response, err := io.ReadAll(conn)
+		conn.Close()
+		if err != nil || string(response) != UpstreamUnavailableMessage {
+			t.Errorf("expected %q, got %q (%v)", UpstreamUnavailableMessage, response, err)
+		}
+	}
+}
+
+func TestParseUpstreams(t *testing.T) {
+	upstreams, err := ParseUpstreams("a.example:1, b.example:2", nil)
+	if err != nil || len(upstreams) != 2 || upstreams[1].Addr != "b.example:2" {
+		t.Errorf("unexpected upstreams %+v (%v)", upstreams, err)
+	}
+	if _, err := ParseUpstreams("no-port", nil); err == nil {
+		t.Error("Addresses without a port should be refused")
+	}
+}
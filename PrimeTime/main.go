@@ -2,11 +2,14 @@ package main
 
 import (
 	"errors"
+	"flag"
 	"fmt"
 	"log"
 	"math"
 	"net"
 	"strings"
+
+	"lightstack.ml/tlsutil"
 )
 
 const (
@@ -98,22 +101,34 @@ func handleConnection(conn net.Conn) {
 	}
 }
 
-func main() {
-	log.Println("Starting server")
-	listen, err := net.Listen(TYPE, HOST+":"+PORT)
-	if err != nil {
-		log.Fatalf(err.Error())
-	}
-	defer listen.Close()
-
+// Accepts connections until the listener fails
+func Serve(listen net.Listener) error {
 	for {
 		conn, err := listen.Accept()
 		if err != nil {
-			log.Fatalf(err.Error())
+			return err
 		}
 		log.Println("Got Connection ...")
 		go handleConnection(conn)
 
 	}
+}
+
+func main() {
+	tlsOptions := tlsutil.RegisterFlags()
+	flag.Parse()
+
+	tlsConfig, err := tlsOptions.ServerConfig()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	log.Println("Starting server")
+	listen, err := tlsutil.Listen(TYPE, HOST+":"+PORT, tlsConfig)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer listen.Close()
 
+	log.Fatal(Serve(listen))
 }
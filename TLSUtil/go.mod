@@ -0,0 +1,3 @@
+module lightstack.ml/tlsutil
+
+go 1.18
@@ -0,0 +1,220 @@
+// TLS setup shared by all the servers: flags for a certificate, optional
+// client certificates and generating certificates for development.
+package tlsutil
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"flag"
+	"math/big"
+	"net"
+	"os"
+	"time"
+)
+
+// Where the TLS certificate comes from, TLS is off if everything is empty
+type Options struct {
+	CertFile string
+	KeyFile  string
+	// Generate a certificate for development, written to CertFile and
+	// KeyFile if they are set and don't exist yet
+	SelfSigned bool
+	// Only accept clients with a certificate signed by this CA
+	ClientCAFile string
+}
+
+func RegisterFlags() *Options {
+	options := &Options{}
+	flag.StringVar(&options.CertFile, "tls-cert", "", "PEM certificate to serve TLS with")
+	flag.StringVar(&options.KeyFile, "tls-key", "", "PEM private key of the TLS certificate")
+	flag.BoolVar(&options.SelfSigned, "tls-self-signed", false, "serve TLS with a generated self-signed certificate (development only)")
+	flag.StringVar(&options.ClientCAFile, "tls-client-ca", "", "require client certificates signed by this PEM CA")
+	return options
+}
+
+func (o *Options) Enabled() bool {
+	return o.SelfSigned || o.CertFile != "" || o.KeyFile != ""
+}
+
+// Builds the server side TLS config, nil if TLS is off
+func (o *Options) ServerConfig() (*tls.Config, error) {
+	if !o.Enabled() {
+		return nil, nil
+	}
+
+	var cert tls.Certificate
+	var err error
+	switch {
+	case o.SelfSigned && !fileExists(o.CertFile) && !fileExists(o.KeyFile):
+		cert, err = GenerateSelfSignedCert([]string{"localhost", "127.0.0.1", "::1"})
+		if err == nil && o.CertFile != "" && o.KeyFile != "" {
+			err = WriteCertificate(cert, o.CertFile, o.KeyFile)
+		}
+	case o.CertFile == "" || o.KeyFile == "":
+		err = errors.New("TLS needs both a certificate and a key")
+	default:
+		cert, err = tls.LoadX509KeyPair(o.CertFile, o.KeyFile)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	config := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+	if o.ClientCAFile != "" {
+		pool, err := LoadCertPool(o.ClientCAFile)
+		if err != nil {
+			return nil, err
+		}
+		config.ClientCAs = pool
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return config, nil
+}
+
+func fileExists(path string) bool {
+	if path == "" {
+		return false
+	}
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+func LoadCertPool(path string) (*x509.CertPool, error) {
+	caPEM, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(caPEM) {
+		return nil, errors.New("no certificates found in " + path)
+	}
+	return pool, nil
+}
+
+// Listens on addr, speaking TLS if config is not nil
+func Listen(network string, addr string, config *tls.Config) (net.Listener, error) {
+	listen, err := net.Listen(network, addr)
+	if err != nil {
+		return nil, err
+	}
+	if config != nil {
+		listen = tls.NewListener(listen, config)
+	}
+	return listen, nil
+}
+
+// Creates a self-signed certificate valid for the given hostnames and IPs
+func GenerateSelfSignedCert(hosts []string) (tls.Certificate, error) {
+	return GenerateCert(hosts, nil)
+}
+
+// Creates a certificate for hosts signed by parent, or self-signed if
+// parent is nil. A self-signed certificate may sign other certificates.
+func GenerateCert(hosts []string, parent *tls.Certificate) (tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{Organization: []string{"Protohackers Development"}},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(365 * 24 * time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	if len(hosts) > 0 {
+		template.Subject.CommonName = hosts[0]
+	}
+	for _, host := range hosts {
+		if ip := net.ParseIP(host); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, host)
+		}
+	}
+
+	signerCert, signerKey := template, interface{}(key)
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		template.KeyUsage |= x509.KeyUsageCertSign
+	} else {
+		signerCert, err = x509.ParseCertificate(parent.Certificate[0])
+		if err != nil {
+			return tls.Certificate{}, err
+		}
+		signerKey = parent.PrivateKey
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, signerCert, &key.PublicKey, signerKey)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, nil
+}
+
+// Stores cert and its key as PEM files
+func WriteCertificate(cert tls.Certificate, certFile string, keyFile string) error {
+	keyDER, err := x509.MarshalPKCS8PrivateKey(cert.PrivateKey)
+	if err != nil {
+		return err
+	}
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Certificate[0]})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER})
+
+	if err := os.WriteFile(certFile, certPEM, 0644); err != nil {
+		return err
+	}
+	return os.WriteFile(keyFile, keyPEM, 0600)
+}
+
+// Server and client configs for tests, both signed by a fresh CA that only
+// lives in memory. The server requires the client's certificate.
+func NewTestConfigs() (server *tls.Config, client *tls.Config, err error) {
+	ca, err := GenerateSelfSignedCert([]string{"Test CA"})
+	if err != nil {
+		return nil, nil, err
+	}
+	serverCert, err := GenerateCert([]string{"localhost", "127.0.0.1"}, &ca)
+	if err != nil {
+		return nil, nil, err
+	}
+	clientCert, err := GenerateCert([]string{"client"}, &ca)
+	if err != nil {
+		return nil, nil, err
+	}
+	caCert, err := x509.ParseCertificate(ca.Certificate[0])
+	if err != nil {
+		return nil, nil, err
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(caCert)
+
+	server = &tls.Config{
+		Certificates: []tls.Certificate{serverCert},
+		MinVersion:   tls.VersionTLS12,
+		ClientCAs:    roots,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+	}
+	client = &tls.Config{
+		Certificates: []tls.Certificate{clientCert},
+		RootCAs:      roots,
+		ServerName:   "127.0.0.1",
+	}
+	return server, client, nil
+}
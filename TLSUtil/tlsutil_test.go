@@ -0,0 +1,191 @@
+package tlsutil
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// In-memory CA with a server and a client certificate signed by it
+type testPKI struct {
+	dir        string
+	roots      *x509.CertPool
+	clientCert tls.Certificate
+	options    Options
+}
+
+func newTestPKI(t *testing.T) testPKI {
+	ca, err := GenerateSelfSignedCert([]string{"Test CA"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverCert, err := GenerateCert([]string{"localhost", "127.0.0.1"}, &ca)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientCert, err := GenerateCert([]string{"client"}, &ca)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	pki := testPKI{
+		dir:        dir,
+		roots:      x509.NewCertPool(),
+		clientCert: clientCert,
+		options: Options{
+			CertFile:     filepath.Join(dir, "server.pem"),
+			KeyFile:      filepath.Join(dir, "server.key"),
+			ClientCAFile: filepath.Join(dir, "ca.pem"),
+		},
+	}
+	caCert, _ := x509.ParseCertificate(ca.Certificate[0])
+	pki.roots.AddCert(caCert)
+
+	if err := WriteCertificate(serverCert, pki.options.CertFile, pki.options.KeyFile); err != nil {
+		t.Fatal(err)
+	}
+	if err := WriteCertificate(ca, pki.options.ClientCAFile, filepath.Join(dir, "ca.key")); err != nil {
+		t.Fatal(err)
+	}
+	return pki
+}
+
+// Echoes everything back over TLS
+func startTLSServer(t *testing.T, options Options) string {
+	config, err := options.ServerConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	listen, err := Listen("tcp", "127.0.0.1:0", config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listen.Close() })
+	go func() {
+		for {
+			conn, err := listen.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return listen.Addr().String()
+}
+
+func TestTLSWithClientCert(t *testing.T) {
+	pki := newTestPKI(t)
+	addr := startTLSServer(t, pki.options)
+
+	conn, err := tls.Dial("tcp", addr, &tls.Config{
+		RootCAs:      pki.roots,
+		Certificates: []tls.Certificate{pki.clientCert},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	conn.Write([]byte("hello"))
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "hello" {
+		t.Errorf("expected echo of hello, got %q (%v)", buf, err)
+	}
+}
+
+func TestTLSRejectsClientWithoutCert(t *testing.T) {
+	pki := newTestPKI(t)
+	addr := startTLSServer(t, pki.options)
+
+	conn, err := tls.Dial("tcp", addr, &tls.Config{RootCAs: pki.roots})
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	// With TLS 1.3 the rejection only shows up once we read
+	conn.Write([]byte("hello"))
+	if _, err := conn.Read(make([]byte, 5)); err == nil {
+		t.Error("Server should not talk to clients without a certificate")
+	}
+}
+
+func TestSelfSignedCertIsWrittenAndReused(t *testing.T) {
+	dir := t.TempDir()
+	options := Options{
+		SelfSigned: true,
+		CertFile:   filepath.Join(dir, "cert.pem"),
+		KeyFile:    filepath.Join(dir, "key.pem"),
+	}
+	addr := startTLSServer(t, options)
+
+	// Clients can trust the generated certificate once it is on disk
+	roots, err := LoadCertPool(options.CertFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := tls.Dial("tcp", addr, &tls.Config{RootCAs: roots})
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+
+	// A restart keeps using the same certificate
+	first, _ := options.ServerConfig()
+	second, _ := options.ServerConfig()
+	if string(first.Certificates[0].Certificate[0]) != string(second.Certificates[0].Certificate[0]) {
+		t.Error("Self-signed certificate should be reused once written")
+	}
+}
+
+func TestTLSDisabledByDefault(t *testing.T) {
+	config, err := (&Options{}).ServerConfig()
+	if config != nil || err != nil {
+		t.Errorf("expected no TLS config, got %v (%v)", config, err)
+	}
+
+	_, err = (&Options{CertFile: "cert.pem"}).ServerConfig()
+	if err == nil {
+		t.Error("A certificate without a key should be refused")
+	}
+}
+
+func TestNewTestConfigs(t *testing.T) {
+	server, client, err := NewTestConfigs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	listen, err := Listen("tcp", "127.0.0.1:0", server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listen.Close()
+	go func() {
+		conn, err := listen.Accept()
+		if err == nil {
+			io.Copy(conn, conn)
+			conn.Close()
+		}
+	}()
+
+	conn, err := tls.Dial("tcp", listen.Addr().String(), client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	conn.Write([]byte("hello"))
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "hello" {
+		t.Errorf("expected echo of hello, got %q (%v)", buf, err)
+	}
+}
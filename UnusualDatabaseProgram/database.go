@@ -0,0 +1,144 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// No reserved keys unless asked for, the protocol lets clients use any key
+const DefaultReservedPrefix = ""
+
+// Like version, answers with how many keys expired. Only read-only with
+// TTLs enabled, otherwise it's an ordinary key.
+const ExpiredKey = "expired"
+
+var ErrReadOnly = errors.New("key is read-only")
+
+// Answers requests the same way no matter how they come in. If there is a
+// reserved prefix, keys starting with it belong to the server: they're
+// read-only and some of them are computed on every read, e.g. _stats.keys
+// with the prefix "_".
+type Database struct {
+	// Only touched atomically, first for 64 bit alignment
+	requests uint64
+
+	store          Store
+	reservedPrefix string
+	computed       map[string]func() string
+	admin          bool
+	started        time.Time
+	// nil unless TTLs are enabled
+	expiry *expiry
+	// Replaced in tests
+	now func() time.Time
+}
+
+// With admin set, <reserved prefix>keys.<prefix> lists all keys starting
+// with prefix, one per line
+func NewDatabase(store Store, reservedPrefix string, admin bool) *Database {
+	db := &Database{store: store, reservedPrefix: reservedPrefix, admin: admin, started: time.Now(), now: time.Now}
+	db.computed = map[string]func() string{
+		"stats.keys": func() string {
+			return strconv.Itoa(db.store.Len())
+		},
+		"stats.uptime": func() string {
+			return strconv.Itoa(int(db.now().Sub(db.started).Seconds()))
+		},
+		"stats.requests": func() string {
+			return strconv.FormatUint(atomic.LoadUint64(&db.requests), 10)
+		},
+		"stats.expired": func() string {
+			return strconv.FormatUint(db.expiredCount(), 10)
+		},
+	}
+	return db
+}
+
+// Whether clients may not change key
+func (db *Database) ReadOnly(key string) bool {
+	return key == "version" || (db.expiry != nil && key == ExpiredKey) || (db.reservedPrefix != "" && strings.HasPrefix(key, db.reservedPrefix))
+}
+
+// Returns the value of key and whether it has one
+func (db *Database) Get(key string) (string, bool) {
+	atomic.AddUint64(&db.requests, 1)
+	if key == "version" {
+		return VERSION, true
+	}
+	if db.expiry != nil && key == ExpiredKey {
+		return strconv.FormatUint(db.expiredCount(), 10), true
+	}
+	if db.ReadOnly(key) {
+		return db.reserved(strings.TrimPrefix(key, db.reservedPrefix))
+	}
+	if db.expiry != nil {
+		return db.getExpiring(key)
+	}
+	return db.store.Get(key)
+}
+
+func (db *Database) reserved(name string) (string, bool) {
+	if prefix := strings.TrimPrefix(name, "keys."); db.admin && prefix != name {
+		keys := db.store.Keys(prefix)
+		sort.Strings(keys)
+		return strings.Join(keys, "\n"), true
+	}
+	if compute, ok := db.computed[name]; ok {
+		return compute(), true
+	}
+	return "", false
+}
+
+func (db *Database) Set(key string, value string) error {
+	return db.SetWithTTL(key, value, 0)
+}
+
+// Stores value for key until ttl has passed, or forever if ttl is 0
+func (db *Database) SetWithTTL(key string, value string, ttl time.Duration) error {
+	atomic.AddUint64(&db.requests, 1)
+	if db.ReadOnly(key) {
+		return ErrReadOnly
+	}
+	if db.expiry != nil {
+		return db.setExpiring(key, value, ttl)
+	}
+	if ttl > 0 {
+		return ErrTTLDisabled
+	}
+	return db.store.Set(key, value)
+}
+
+func (db *Database) Delete(key string) error {
+	atomic.AddUint64(&db.requests, 1)
+	if db.ReadOnly(key) {
+		return ErrReadOnly
+	}
+	if db.expiry != nil {
+		return db.deleteExpiring(key)
+	}
+	return db.store.Delete(key)
+}
+
+// Handles one request in the UDP format, key=value inserts and anything
+// else retrieves. With TTLs enabled key@<duration>=value inserts expire.
+// Returns the response and whether there is one.
+func (db *Database) Handle(request string) (string, bool) {
+	key, value, insert := strings.Cut(request, "=")
+	if insert {
+		var ttl time.Duration
+		if db.expiry != nil {
+			key, ttl, _ = splitTTL(key)
+		}
+		if err := db.SetWithTTL(key, value, ttl); err != nil && err != ErrReadOnly {
+			log.Println("Can't store value: ", err)
+		}
+		return "", false
+	}
+	value, _ = db.Get(key)
+	return key + "=" + value, true
+}
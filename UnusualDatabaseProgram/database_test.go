@@ -0,0 +1,52 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestReservedKeys(t *testing.T) {
+	type test struct {
+		Prefix   string
+		Admin    bool
+		Requests []string
+		// Response to the last request
+		Expected string
+	}
+
+	testCases := []test{
+		{Prefix: "_", Requests: []string{"a=1", "b=2", "a=3", "_stats.keys"}, Expected: "_stats.keys=2"},
+		{Prefix: "_", Requests: []string{"a", "b=2", "_stats.requests"}, Expected: "_stats.requests=3"},
+		{Prefix: "_", Requests: []string{"_stats.uptime"}, Expected: "_stats.uptime=0"},
+		{Prefix: "_", Requests: []string{"_unknown"}, Expected: "_unknown="},
+		// Read-only
+		{Prefix: "_", Requests: []string{"_stats.keys=100", "_stats.keys"}, Expected: "_stats.keys=0"},
+		{Prefix: "_", Requests: []string{"_mine=1", "_mine"}, Expected: "_mine="},
+		{Prefix: "_", Requests: []string{"version=2", "version"}, Expected: "version=" + VERSION},
+		// Listing keys
+		{Prefix: "_", Admin: true, Requests: []string{"user2=x", "user1=y", "other=z", "_keys.user"}, Expected: "_keys.user=user1\nuser2"},
+		{Prefix: "_", Admin: true, Requests: []string{"b=x", "a=y", "_keys."}, Expected: "_keys.=a\nb"},
+		{Prefix: "_", Requests: []string{"user1=y", "_keys.user"}, Expected: "_keys.user="},
+		// Somewhere else
+		{Prefix: "sys.", Requests: []string{"_mine=1", "_mine"}, Expected: "_mine=1"},
+		{Prefix: "sys.", Requests: []string{"_mine=1", "sys.stats.keys"}, Expected: "sys.stats.keys=1"},
+		// Nothing reserved by default
+		{Prefix: DefaultReservedPrefix, Requests: []string{"_stats.keys=1", "_stats.keys"}, Expected: "_stats.keys=1"},
+		{Prefix: DefaultReservedPrefix, Requests: []string{"_keys.=1", "_keys."}, Expected: "_keys.=1"},
+	}
+
+	for _, tc := range testCases {
+		db := NewDatabase(NewShardedStore(DefaultShards), tc.Prefix, tc.Admin)
+		var response string
+		for _, request := range tc.Requests {
+			response, _ = db.Handle(request)
+		}
+		if response != tc.Expected {
+			t.Errorf("Prefix: %q, requests: %q, expected: %q, got: %q", tc.Prefix, tc.Requests, tc.Expected, response)
+		}
+	}
+
+	db := NewDatabase(NewShardedStore(DefaultShards), "_", false)
+	if err := db.Set("_stats.keys", "1"); err != ErrReadOnly {
+		t.Errorf("expected %v, got %v", ErrReadOnly, err)
+	}
+}
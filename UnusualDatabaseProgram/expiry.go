@@ -0,0 +1,126 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+var ErrTTLDisabled = errors.New("TTLs are not enabled")
+
+// When keys set with a TTL are due. Writes hold mu, so a key that expires
+// can't take a fresh value with it.
+type expiry struct {
+	mu        sync.RWMutex
+	deadlines map[string]time.Time
+	// Guarded by mu as well
+	expired uint64
+}
+
+// Allows inserts like key@30s=value, the key then goes away after 30
+// seconds. Off by default since it changes what keys mean. Deadlines only
+// live in memory, after a restart those keys stay.
+func (db *Database) EnableTTL() {
+	db.expiry = &expiry{deadlines: make(map[string]time.Time)}
+}
+
+// Splits key@<duration> into key and duration
+func splitTTL(key string) (string, time.Duration, bool) {
+	at := strings.LastIndexByte(key, '@')
+	if at < 0 {
+		return key, 0, false
+	}
+	ttl, err := time.ParseDuration(key[at+1:])
+	if err != nil || ttl <= 0 {
+		return key, 0, false
+	}
+	return key[:at], ttl, true
+}
+
+// Whether key has a deadline that passed, must hold expiry.mu
+func (db *Database) isDue(key string, now time.Time) bool {
+	deadline, ok := db.expiry.deadlines[key]
+	return ok && !now.Before(deadline)
+}
+
+// Removes key if it's due, must hold expiry.mu for writing
+func (db *Database) expireIfDue(key string, now time.Time) {
+	if !db.isDue(key, now) {
+		return
+	}
+	if err := db.store.Delete(key); err != nil {
+		log.Printf("Can't expire %q: %v", key, err)
+		return
+	}
+	delete(db.expiry.deadlines, key)
+	db.expiry.expired++
+}
+
+// Removes every key that is due, so keys nobody asks for don't pile up
+func (db *Database) ExpireDue() {
+	if db.expiry == nil {
+		return
+	}
+	db.expiry.mu.Lock()
+	defer db.expiry.mu.Unlock()
+	now := db.now()
+	for key := range db.expiry.deadlines {
+		db.expireIfDue(key, now)
+	}
+}
+
+// Looks up key, removing it first if it's due
+func (db *Database) getExpiring(key string) (string, bool) {
+	now := db.now()
+	db.expiry.mu.RLock()
+	if !db.isDue(key, now) {
+		defer db.expiry.mu.RUnlock()
+		return db.store.Get(key)
+	}
+	db.expiry.mu.RUnlock()
+
+	db.expiry.mu.Lock()
+	defer db.expiry.mu.Unlock()
+	db.expireIfDue(key, now)
+	return db.store.Get(key)
+}
+
+// Stores value for key, forever if ttl is 0
+func (db *Database) setExpiring(key string, value string, ttl time.Duration) error {
+	db.expiry.mu.Lock()
+	defer db.expiry.mu.Unlock()
+	if err := db.store.Set(key, value); err != nil {
+		return err
+	}
+	if ttl > 0 {
+		db.expiry.deadlines[key] = db.now().Add(ttl)
+	} else {
+		delete(db.expiry.deadlines, key)
+	}
+	return nil
+}
+
+func (db *Database) deleteExpiring(key string) error {
+	db.expiry.mu.Lock()
+	defer db.expiry.mu.Unlock()
+	delete(db.expiry.deadlines, key)
+	return db.store.Delete(key)
+}
+
+// Calls ExpireDue every interval, forever
+func (db *Database) ExpireEvery(interval time.Duration) {
+	for range time.Tick(interval) {
+		db.ExpireDue()
+	}
+}
+
+func (db *Database) expiredCount() uint64 {
+	if db.expiry == nil {
+		return 0
+	}
+	db.expiry.mu.RLock()
+	defer db.expiry.mu.RUnlock()
+	return db.expiry.expired
+}
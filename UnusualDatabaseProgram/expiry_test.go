@@ -0,0 +1,177 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+type fakeClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+}
+
+func newTTLDatabase(clock *fakeClock) *Database {
+	db := newTestDatabase(false)
+	db.now = clock.Now
+	db.started = clock.Now()
+	db.EnableTTL()
+	return db
+}
+
+func TestSplitTTL(t *testing.T) {
+	type test struct {
+		Key      string
+		Expected string
+		TTL      time.Duration
+	}
+	testCases := []test{
+		{Key: "session@30s", Expected: "session", TTL: 30 * time.Second},
+		{Key: "a@b@1h30m", Expected: "a@b", TTL: 90 * time.Minute},
+		{Key: "@1m", Expected: "", TTL: time.Minute},
+		{Key: "plain", Expected: "plain"},
+		{Key: "mail@example.com", Expected: "mail@example.com"},
+		{Key: "never@0s", Expected: "never@0s"},
+		{Key: "past@-5s", Expected: "past@-5s"},
+		{Key: "trailing@", Expected: "trailing@"},
+	}
+	for _, tc := range testCases {
+		if key, ttl, _ := splitTTL(tc.Key); key != tc.Expected || ttl != tc.TTL {
+			t.Errorf("Key: %q, expected: %q %v, got: %q %v", tc.Key, tc.Expected, tc.TTL, key, ttl)
+		}
+	}
+}
+
+func TestExpiry(t *testing.T) {
+	type step struct {
+		// Before the requests
+		Advance  time.Duration
+		Deletes  []string
+		Requests []string
+		// Retrieve and what it should answer
+		Query    string
+		Expected string
+	}
+	steps := []step{
+		{Requests: []string{"a@10s=1", "b=2", "c@1m=3", "d@10s=4"}, Query: "a", Expected: "a=1"},
+		{Advance: 9 * time.Second, Query: "a", Expected: "a=1"},
+		// Nobody asked for d, so it's still around until the next sweep
+		{Advance: time.Second, Query: "a", Expected: "a="},
+		{Query: "_stats.expired", Expected: "_stats.expired=1"},
+		{Query: "_stats.keys", Expected: "_stats.keys=3"},
+		{Query: "b", Expected: "b=2"},
+		// Overwriting without a TTL keeps it forever, with one starts over
+		{Requests: []string{"c=5", "e@10s=6", "e@1h=7"}, Advance: 0, Query: "c", Expected: "c=5"},
+		{Advance: time.Hour - time.Second, Query: "c", Expected: "c=5"},
+		{Query: "e", Expected: "e=7"},
+		{Advance: time.Second, Query: "e", Expected: "e="},
+		// Deleted keys don't keep their deadline
+		{Requests: []string{"f@10s=8"}, Query: "f", Expected: "f=8"},
+		{Deletes: []string{"f"}, Query: "f", Expected: "f="},
+		{Advance: 20 * time.Second, Query: "_stats.uptime", Expected: "_stats.uptime=3630"},
+		{Query: "_stats.expired", Expected: "_stats.expired=2"},
+	}
+
+	clock := &fakeClock{now: time.Date(2022, 10, 1, 12, 0, 0, 0, time.UTC)}
+	db := newTTLDatabase(clock)
+	for i, step := range steps {
+		clock.Advance(step.Advance)
+		for _, key := range step.Deletes {
+			db.Delete(key)
+		}
+		for _, request := range step.Requests {
+			db.Handle(request)
+		}
+		if response, _ := db.Handle(step.Query); response != step.Expected {
+			t.Errorf("Step %d: expected: %q, got: %q", i, step.Expected, response)
+		}
+	}
+
+	// Behind the database's back, so only a leftover deadline could remove it
+	db.store.Set("f", "forever")
+	db.ExpireDue()
+	for query, expected := range map[string]string{"_stats.expired": "_stats.expired=3", "d": "d=", "f": "f=forever", "_stats.keys": "_stats.keys=3"} {
+		if response, _ := db.Handle(query); response != expected {
+			t.Errorf("After sweep: expected: %q, got: %q", expected, response)
+		}
+	}
+}
+
+func TestExpiredKey(t *testing.T) {
+	clock := &fakeClock{now: time.Date(2022, 10, 1, 12, 0, 0, 0, time.UTC)}
+	// No reserved prefix, expired works like version anyway
+	db := NewDatabase(NewShardedStore(DefaultShards), "", false)
+	db.now = clock.Now
+	db.EnableTTL()
+
+	db.Handle("a@10s=1")
+	db.Handle("expired=5")
+	clock.Advance(10 * time.Second)
+	db.ExpireDue()
+	if response, _ := db.Handle("expired"); response != "expired=1" {
+		t.Errorf("expected one expired key, got %q", response)
+	}
+	if err := db.Delete("expired"); err != ErrReadOnly {
+		t.Errorf("expected %v, got %v", ErrReadOnly, err)
+	}
+
+	// Without TTLs it's just a key
+	plain := NewDatabase(NewShardedStore(DefaultShards), "", false)
+	plain.Handle("expired=5")
+	if response, _ := plain.Handle("expired"); response != "expired=5" {
+		t.Errorf("expected an ordinary key, got %q", response)
+	}
+}
+
+func TestTTLDisabled(t *testing.T) {
+	db := newTestDatabase(false)
+	db.Handle("a@10s=1")
+	if response, _ := db.Handle("a@10s"); response != "a@10s=1" {
+		t.Errorf("expected a plain key, got %q", response)
+	}
+	if err := db.SetWithTTL("a", "1", time.Second); err != ErrTTLDisabled {
+		t.Errorf("expected %v, got %v", ErrTTLDisabled, err)
+	}
+	if response, _ := db.Handle("_stats.expired"); response != "_stats.expired=0" {
+		t.Errorf("expected no expired keys, got %q", response)
+	}
+}
+
+func TestHTTPTTL(t *testing.T) {
+	clock := &fakeClock{now: time.Date(2022, 10, 1, 12, 0, 0, 0, time.UTC)}
+	withTTL := httptest.NewServer(NewHTTPHandler(newTTLDatabase(clock)))
+	defer withTTL.Close()
+	withoutTTL := httptest.NewServer(NewHTTPHandler(newTestDatabase(false)))
+	defer withoutTTL.Close()
+
+	if status, _ := httpRequest(t, http.MethodPut, withoutTTL.URL+"/keys/a?ttl=10s", "1"); status != http.StatusBadRequest {
+		t.Errorf("expected 400 without TTLs, got %d", status)
+	}
+	if status, _ := httpRequest(t, http.MethodPut, withTTL.URL+"/keys/a?ttl=soon", "1"); status != http.StatusBadRequest {
+		t.Errorf("expected 400 for a bad TTL, got %d", status)
+	}
+	if status, _ := httpRequest(t, http.MethodPut, withTTL.URL+"/keys/a?ttl=10s", "1"); status != http.StatusNoContent {
+		t.Errorf("expected 204, got %d", status)
+	}
+	if status, body := httpRequest(t, http.MethodGet, withTTL.URL+"/keys/a", ""); status != http.StatusOK || body != "1" {
+		t.Errorf("expected 200 %q, got %d %q", "1", status, body)
+	}
+	clock.Advance(10 * time.Second)
+	if status, _ := httpRequest(t, http.MethodGet, withTTL.URL+"/keys/a", ""); status != http.StatusNotFound {
+		t.Errorf("expected 404 once expired, got %d", status)
+	}
+}
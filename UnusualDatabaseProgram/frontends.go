@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Speaks the UDP protocol over TCP, one request per line. Responses end
+// with a newline as well, values with newlines in them come out as several
+// lines.
+func ServeTCP(listen net.Listener, db *Database) error {
+	for {
+		conn, err := listen.Accept()
+		if err != nil {
+			return err
+		}
+		go handleTCPConnection(conn, db)
+	}
+}
+
+func handleTCPConnection(conn net.Conn, db *Database) {
+	defer conn.Close()
+	scanner := bufio.NewScanner(conn)
+	// Same limit as for a datagram, plus the newline
+	scanner.Buffer(make([]byte, MaxPacketSize), MaxPacketSize)
+	for scanner.Scan() {
+		if resp, ok := db.Handle(scanner.Text()); ok {
+			if _, err := conn.Write([]byte(limitResponse(resp) + "\n")); err != nil {
+				return
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		log.Printf("Closing TCP connection from %s: %v", conn.RemoteAddr(), err)
+	}
+}
+
+// REST API on /keys/{key}: GET answers with the value, PUT stores the body
+// as the value and DELETE removes the key. PUT takes a ?ttl=30s if TTLs are
+// enabled.
+func NewHTTPHandler(db *Database) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/keys/", func(w http.ResponseWriter, r *http.Request) {
+		key := strings.TrimPrefix(r.URL.Path, "/keys/")
+		switch r.Method {
+		case http.MethodGet, http.MethodHead:
+			value, ok := db.Get(key)
+			if !ok {
+				http.NotFound(w, r)
+				return
+			}
+			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+			io.WriteString(w, value)
+		case http.MethodPut:
+			// Nothing the other protocols couldn't store either
+			if strings.Contains(key, "=") {
+				http.Error(w, "keys can't contain =", http.StatusBadRequest)
+				return
+			}
+			value, err := io.ReadAll(http.MaxBytesReader(w, r.Body, MaxPacketSize))
+			if err != nil || len(key)+1+len(value) >= MaxPacketSize {
+				http.Error(w, "key and value must be shorter than 1000 bytes together", http.StatusRequestEntityTooLarge)
+				return
+			}
+			var ttl time.Duration
+			if param := r.URL.Query().Get("ttl"); param != "" {
+				if ttl, err = time.ParseDuration(param); err != nil || ttl <= 0 {
+					http.Error(w, "ttl must be a positive duration like 30s", http.StatusBadRequest)
+					return
+				}
+			}
+			writeStoreResult(w, db.SetWithTTL(key, string(value), ttl))
+		case http.MethodDelete:
+			writeStoreResult(w, db.Delete(key))
+		default:
+			w.Header().Set("Allow", "GET, HEAD, PUT, DELETE")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+	return mux
+}
+
+func writeStoreResult(w http.ResponseWriter, err error) {
+	switch err {
+	case nil:
+		w.WriteHeader(http.StatusNoContent)
+	case ErrReadOnly:
+		http.Error(w, err.Error(), http.StatusForbidden)
+	case ErrTTLDisabled:
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	default:
+		log.Println("Can't store value: ", err)
+		http.Error(w, "can't store value", http.StatusInternalServerError)
+	}
+}
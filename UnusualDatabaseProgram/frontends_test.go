@@ -0,0 +1,146 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func startTCPServer(t *testing.T, db *Database) net.Conn {
+	listen, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listen.Close() })
+	go ServeTCP(listen, db)
+
+	conn, err := net.Dial("tcp", listen.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	return conn
+}
+
+func httpRequest(t *testing.T, method string, url string, body string) (int, string) {
+	request, err := http.NewRequest(method, url, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer response.Body.Close()
+	responseBody, _ := io.ReadAll(response.Body)
+	return response.StatusCode, string(responseBody)
+}
+
+func TestFrontendsShareStore(t *testing.T) {
+	db := newTestDatabase(false)
+	udp := dialServer(t, startServer(t, db, 1, RejectOversized))
+	tcp := startTCPServer(t, db)
+	tcpReader := bufio.NewReader(tcp)
+	web := httptest.NewServer(NewHTTPHandler(db))
+	defer web.Close()
+
+	tcpQuery := func(request string) string {
+		tcp.Write([]byte(request + "\n"))
+		line, err := tcpReader.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		return strings.TrimSuffix(line, "\n")
+	}
+
+	// UDP to the others
+	udp.Write([]byte("fromudp=1=2"))
+	query(t, udp, "fromudp")
+	if got := tcpQuery("fromudp"); got != "fromudp=1=2" {
+		t.Errorf("TCP: expected: %q, got: %q", "fromudp=1=2", got)
+	}
+	if status, body := httpRequest(t, http.MethodGet, web.URL+"/keys/fromudp", ""); status != http.StatusOK || body != "1=2" {
+		t.Errorf("HTTP: expected: 200 %q, got: %d %q", "1=2", status, body)
+	}
+
+	// TCP to the others
+	tcp.Write([]byte("fromtcp=yes\n"))
+	if got := tcpQuery("fromtcp"); got != "fromtcp=yes" {
+		t.Errorf("TCP: expected: %q, got: %q", "fromtcp=yes", got)
+	}
+	if got := query(t, udp, "fromtcp"); got != "fromtcp=yes" {
+		t.Errorf("UDP: expected: %q, got: %q", "fromtcp=yes", got)
+	}
+
+	// HTTP to the others, and gone again
+	if status, _ := httpRequest(t, http.MethodPut, web.URL+"/keys/fromhttp", "with\nnewline"); status != http.StatusNoContent {
+		t.Errorf("PUT: expected 204, got %d", status)
+	}
+	if got := query(t, udp, "fromhttp"); got != "fromhttp=with\nnewline" {
+		t.Errorf("UDP: expected: %q, got: %q", "fromhttp=with\nnewline", got)
+	}
+	if status, _ := httpRequest(t, http.MethodDelete, web.URL+"/keys/fromhttp", ""); status != http.StatusNoContent {
+		t.Errorf("DELETE: expected 204, got %d", status)
+	}
+	if got := tcpQuery("fromhttp"); got != "fromhttp=" {
+		t.Errorf("TCP: expected: %q, got: %q", "fromhttp=", got)
+	}
+	if got := tcpQuery("version"); got != "version="+VERSION {
+		t.Errorf("TCP: expected: %q, got: %q", "version="+VERSION, got)
+	}
+}
+
+func TestHTTPStatus(t *testing.T) {
+	type test struct {
+		Method   string
+		Path     string
+		Body     string
+		Status   int
+		Expected string
+	}
+
+	testCases := []test{
+		{Method: http.MethodGet, Path: "/keys/missing", Status: http.StatusNotFound},
+		{Method: http.MethodPut, Path: "/keys/key", Body: "value", Status: http.StatusNoContent},
+		{Method: http.MethodGet, Path: "/keys/key", Status: http.StatusOK, Expected: "value"},
+		{Method: http.MethodPut, Path: "/keys/key", Body: "", Status: http.StatusNoContent},
+		{Method: http.MethodGet, Path: "/keys/key", Status: http.StatusOK, Expected: ""},
+		{Method: http.MethodPut, Path: "/keys/", Body: "empty key", Status: http.StatusNoContent},
+		{Method: http.MethodGet, Path: "/keys/", Status: http.StatusOK, Expected: "empty key"},
+		{Method: http.MethodPut, Path: "/keys/sp%20ace", Body: "escaped", Status: http.StatusNoContent},
+		{Method: http.MethodGet, Path: "/keys/sp%20ace", Status: http.StatusOK, Expected: "escaped"},
+		{Method: http.MethodDelete, Path: "/keys/never-there", Status: http.StatusNoContent},
+		{Method: http.MethodGet, Path: "/keys/version", Status: http.StatusOK, Expected: VERSION},
+		{Method: http.MethodPut, Path: "/keys/version", Body: "2", Status: http.StatusForbidden},
+		{Method: http.MethodDelete, Path: "/keys/_stats.keys", Status: http.StatusForbidden},
+		{Method: http.MethodPut, Path: "/keys/a=b", Body: "c", Status: http.StatusBadRequest},
+		{Method: http.MethodPut, Path: "/keys/big", Body: strings.Repeat("x", 995), Status: http.StatusNoContent},
+		{Method: http.MethodPut, Path: "/keys/big", Body: strings.Repeat("x", 996), Status: http.StatusRequestEntityTooLarge},
+		{Method: http.MethodPost, Path: "/keys/key", Status: http.StatusMethodNotAllowed},
+		{Method: http.MethodGet, Path: "/elsewhere", Status: http.StatusNotFound},
+	}
+
+	web := httptest.NewServer(NewHTTPHandler(newTestDatabase(false)))
+	defer web.Close()
+	for _, tc := range testCases {
+		status, body := httpRequest(t, tc.Method, web.URL+tc.Path, tc.Body)
+		if status != tc.Status || (status == http.StatusOK && body != tc.Expected) {
+			t.Errorf("%s %s: expected: %d %q, got: %d %q", tc.Method, tc.Path, tc.Status, tc.Expected, status, body)
+		}
+	}
+}
+
+func TestTCPLineTooLong(t *testing.T) {
+	conn := startTCPServer(t, newTestDatabase(false))
+	conn.Write([]byte(strings.Repeat("x", 2*MaxPacketSize) + "\n"))
+	// Closed with unread data, so it may as well be reset
+	if line, err := bufio.NewReader(conn).ReadString('\n'); err == nil {
+		t.Errorf("expected the connection to be closed, got %q", line)
+	}
+}
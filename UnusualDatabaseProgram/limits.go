@@ -0,0 +1,50 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+)
+
+// Requests and responses must be shorter than this
+const MaxPacketSize = 1000
+
+// What happens to requests of MaxPacketSize bytes or more
+type OversizePolicy int
+
+const (
+	// Ignore them, like the spec allows
+	RejectOversized OversizePolicy = iota
+	// Store inserts with whatever of the value fits, retrieves are still
+	// ignored since they'd answer for a different key
+	TruncateOversized
+)
+
+func ParseOversizePolicy(s string) (OversizePolicy, error) {
+	switch s {
+	case "reject":
+		return RejectOversized, nil
+	case "truncate":
+		return TruncateOversized, nil
+	}
+	return 0, fmt.Errorf("unknown policy for oversized requests %q (want reject or truncate)", s)
+}
+
+// Returns the part of request that should be handled, false if none of it
+func checkRequestSize(request []byte, policy OversizePolicy) ([]byte, bool) {
+	if len(request) < MaxPacketSize {
+		return request, true
+	}
+	request = request[:MaxPacketSize-1]
+	if policy == TruncateOversized && bytes.IndexByte(request, '=') >= 0 {
+		return request, true
+	}
+	return nil, false
+}
+
+// Cuts a response down to what may be sent
+func limitResponse(response string) string {
+	if len(response) < MaxPacketSize {
+		return response
+	}
+	return response[:MaxPacketSize-1]
+}
@@ -0,0 +1,417 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	SnapshotFile = "snapshot.db"
+	LogFile      = "append.log"
+
+	// checksum, key length, value length
+	RecordHeaderSize = 12
+	// Value lengths of records without a value: deleting their key, and
+	// the replication stream's markers
+	deletedValue     = 0xffffffff
+	snapshotEndValue = 0xfffffffe
+	heartbeatValue   = 0xfffffffd
+	// Way more than fits into a packet, anything bigger is garbage
+	MaxRecordSize = 1 << 20
+)
+
+var errCorruptRecord = errors.New("corrupt record")
+
+// When writes are flushed to disk. Everything that was acknowledged
+// survives the process getting killed either way, only SyncAlways also
+// survives the machine going down.
+type SyncPolicy int
+
+const (
+	// Before acknowledging every write
+	SyncAlways SyncPolicy = iota
+	// Every SyncInterval in the background
+	SyncPeriodically
+	// Whenever the OS feels like it
+	SyncNever
+)
+
+func ParseSyncPolicy(s string) (SyncPolicy, error) {
+	switch s {
+	case "always":
+		return SyncAlways, nil
+	case "interval":
+		return SyncPeriodically, nil
+	case "never":
+		return SyncNever, nil
+	}
+	return 0, fmt.Errorf("unknown fsync policy %q (want always, interval or never)", s)
+}
+
+type LogStoreOptions struct {
+	Sync         SyncPolicy
+	SyncInterval time.Duration
+	// Fold the log into a fresh snapshot once it grows beyond this many
+	// bytes, 0 never does
+	CompactThreshold int64
+}
+
+// What LogStore needs of its log, an *os.File outside of tests
+type logFile interface {
+	io.Writer
+	io.Seeker
+	Truncate(size int64) error
+	Sync() error
+	Close() error
+}
+
+// Keeps everything in memory and appends every write to a log on disk. On
+// open the last snapshot is loaded and the log replayed on top of it.
+type LogStore struct {
+	mu      sync.Mutex
+	dir     string
+	options LogStoreOptions
+	data    map[string]string
+	log     logFile
+	logSize int64
+	done    chan struct{}
+	wg      sync.WaitGroup
+}
+
+func OpenLogStore(dir string, options LogStoreOptions) (*LogStore, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	s := &LogStore{dir: dir, options: options, data: make(map[string]string), done: make(chan struct{})}
+
+	// Left over from a compaction that didn't finish
+	os.Remove(filepath.Join(dir, SnapshotFile+".tmp"))
+	if err := s.loadSnapshot(); err != nil {
+		return nil, err
+	}
+	if err := s.replayLog(); err != nil {
+		return nil, err
+	}
+
+	if options.Sync == SyncPeriodically && options.SyncInterval > 0 {
+		s.wg.Add(1)
+		go s.syncPeriodically()
+	}
+	return s, nil
+}
+
+func (s *LogStore) loadSnapshot() error {
+	file, err := os.Open(filepath.Join(s.dir, SnapshotFile))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	// Snapshots only ever appear complete, so any damage is real
+	if _, err := readRecords(file, s.data); err != nil && err != io.EOF {
+		return fmt.Errorf("%s: %w", SnapshotFile, err)
+	}
+	return nil
+}
+
+func (s *LogStore) replayLog() error {
+	file, err := os.OpenFile(filepath.Join(s.dir, LogFile), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	good, err := readRecords(file, s.data)
+	switch err {
+	case io.EOF:
+	case io.ErrUnexpectedEOF, errCorruptRecord:
+		// Most likely the last write got cut short by a crash
+		log.Printf("Dropping log after byte %d: %v", good, err)
+		if err := file.Truncate(good); err != nil {
+			file.Close()
+			return err
+		}
+	default:
+		file.Close()
+		return err
+	}
+	if _, err := file.Seek(good, io.SeekStart); err != nil {
+		file.Close()
+		return err
+	}
+	s.log = file
+	s.logSize = good
+	return nil
+}
+
+func (s *LogStore) syncPeriodically() {
+	defer s.wg.Done()
+	ticker := time.NewTicker(s.options.SyncInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			s.mu.Lock()
+			if err := s.log.Sync(); err != nil {
+				log.Println("Can't sync log: ", err)
+			}
+			s.mu.Unlock()
+		case <-s.done:
+			return
+		}
+	}
+}
+
+func (s *LogStore) Get(key string) (string, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	value, ok := s.data[key]
+	return value, ok
+}
+
+func (s *LogStore) Set(key string, value string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.append(encodeRecord(key, value)); err != nil {
+		return err
+	}
+	s.data[key] = value
+	s.compactIfNeeded()
+	return nil
+}
+
+func (s *LogStore) Delete(key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.data[key]; !ok {
+		return nil
+	}
+	if err := s.append(encodeDelete(key)); err != nil {
+		return err
+	}
+	delete(s.data, key)
+	s.compactIfNeeded()
+	return nil
+}
+
+func (s *LogStore) append(record []byte) error {
+	// One write per record, so a crash can only ever tear the last one
+	n, err := s.log.Write(record)
+	if err != nil {
+		// Don't leave half a record for the next one to land behind
+		s.rollback()
+		return err
+	}
+	if s.options.Sync == SyncAlways {
+		if err := s.log.Sync(); err != nil {
+			// The client hears it failed, so it mustn't come back on restart
+			s.rollback()
+			return err
+		}
+	}
+	s.logSize += int64(n)
+	return nil
+}
+
+// Cuts the log back to where it was before the last write
+func (s *LogStore) rollback() {
+	if err := s.log.Truncate(s.logSize); err != nil {
+		log.Println("Can't roll back log: ", err)
+	}
+	if _, err := s.log.Seek(s.logSize, io.SeekStart); err != nil {
+		log.Println("Can't roll back log: ", err)
+	}
+}
+
+func (s *LogStore) compactIfNeeded() {
+	if s.options.CompactThreshold > 0 && s.logSize >= s.options.CompactThreshold {
+		if err := s.compact(); err != nil {
+			// The log still has everything, try again next time
+			log.Println("Compaction failed: ", err)
+		}
+	}
+}
+
+func (s *LogStore) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.data)
+}
+
+func (s *LogStore) Keys(prefix string) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return appendKeys(nil, s.data, prefix)
+}
+
+// Folds the log into a new snapshot
+func (s *LogStore) Compact() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.compact()
+}
+
+func (s *LogStore) compact() error {
+	// Write the snapshot next to the old one and swap them, so there's
+	// always a complete one on disk
+	path := filepath.Join(s.dir, SnapshotFile)
+	tmp, err := os.Create(path + ".tmp")
+	if err != nil {
+		return err
+	}
+	writer := bufio.NewWriter(tmp)
+	for key, value := range s.data {
+		writer.Write(encodeRecord(key, value))
+	}
+	if err := writer.Flush(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return err
+	}
+	if err := syncDir(s.dir); err != nil {
+		return err
+	}
+
+	// Dying before this only means replaying writes the snapshot already has
+	if err := s.log.Truncate(0); err != nil {
+		return err
+	}
+	if _, err := s.log.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	s.logSize = 0
+	return s.log.Sync()
+}
+
+func (s *LogStore) Close() error {
+	close(s.done)
+	s.wg.Wait()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.log.Sync(); err != nil {
+		s.log.Close()
+		return err
+	}
+	return s.log.Close()
+}
+
+// Makes renames in dir stick
+func syncDir(dir string) error {
+	file, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	return file.Sync()
+}
+
+func encodeRecord(key string, value string) []byte {
+	record := make([]byte, RecordHeaderSize+len(key)+len(value))
+	binary.BigEndian.PutUint32(record[4:8], uint32(len(key)))
+	binary.BigEndian.PutUint32(record[8:12], uint32(len(value)))
+	copy(record[RecordHeaderSize:], key)
+	copy(record[RecordHeaderSize+len(key):], value)
+	binary.BigEndian.PutUint32(record[0:4], crc32.ChecksumIEEE(record[4:]))
+	return record
+}
+
+func encodeDelete(key string) []byte {
+	return encodeMarker(key, deletedValue)
+}
+
+func encodeMarker(key string, marker uint32) []byte {
+	record := make([]byte, RecordHeaderSize+len(key))
+	binary.BigEndian.PutUint32(record[4:8], uint32(len(key)))
+	binary.BigEndian.PutUint32(record[8:12], marker)
+	copy(record[RecordHeaderSize:], key)
+	binary.BigEndian.PutUint32(record[0:4], crc32.ChecksumIEEE(record[4:]))
+	return record
+}
+
+type record struct {
+	key   string
+	value string
+	// Value length of records without a value, 0 for the others
+	marker uint32
+	// Encoded
+	size int
+}
+
+func readRecord(reader *bufio.Reader) (record, error) {
+	header := make([]byte, RecordHeaderSize)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return record{}, err
+	}
+	keyLength := binary.BigEndian.Uint32(header[4:8])
+	valueLength := binary.BigEndian.Uint32(header[8:12])
+	var marker uint32
+	if valueLength > MaxRecordSize {
+		marker, valueLength = valueLength, 0
+	}
+	if keyLength > MaxRecordSize || (marker != 0 && marker < heartbeatValue) {
+		return record{}, errCorruptRecord
+	}
+
+	body := make([]byte, keyLength+valueLength)
+	if _, err := io.ReadFull(reader, body); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return record{}, err
+	}
+	checksum := crc32.NewIEEE()
+	checksum.Write(header[4:])
+	checksum.Write(body)
+	if checksum.Sum32() != binary.BigEndian.Uint32(header[0:4]) {
+		return record{}, errCorruptRecord
+	}
+	return record{
+		key:    string(body[:keyLength]),
+		value:  string(body[keyLength:]),
+		marker: marker,
+		size:   len(header) + len(body),
+	}, nil
+}
+
+// Reads records from r into data until something goes wrong. Returns how
+// many bytes of good records there were and io.EOF if that was all of them.
+func readRecords(r io.Reader, data map[string]string) (int64, error) {
+	reader := bufio.NewReader(r)
+	var good int64
+	for {
+		record, err := readRecord(reader)
+		if err != nil {
+			return good, err
+		}
+		switch record.marker {
+		case 0:
+			data[record.key] = record.value
+		case deletedValue:
+			delete(data, record.key)
+		default:
+			// Only replication uses the others
+			return good, errCorruptRecord
+		}
+		good += int64(record.size)
+	}
+}
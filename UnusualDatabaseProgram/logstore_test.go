@@ -0,0 +1,296 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func openTestStore(t *testing.T, dir string, options LogStoreOptions) *LogStore {
+	store, err := OpenLogStore(dir, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return store
+}
+
+func expectValues(t *testing.T, store Store, expected map[string]string) {
+	for key, value := range expected {
+		if got, ok := store.Get(key); !ok || got != value {
+			t.Errorf("Key: %q, expected: %q, got: %q (%v)", key, value, got, ok)
+		}
+	}
+}
+
+func TestLogStoreReopen(t *testing.T) {
+	type test struct {
+		Name    string
+		Options LogStoreOptions
+	}
+	testCases := []test{
+		{Name: "always", Options: LogStoreOptions{Sync: SyncAlways}},
+		{Name: "interval", Options: LogStoreOptions{Sync: SyncPeriodically, SyncInterval: time.Millisecond}},
+		{Name: "never", Options: LogStoreOptions{Sync: SyncNever}},
+		{Name: "compacting", Options: LogStoreOptions{Sync: SyncAlways, CompactThreshold: 64}},
+	}
+
+	expected := map[string]string{
+		"foo":   "overwritten",
+		"":      "empty key",
+		"empty": "",
+		"weird": "a=b=c\nwith newline\x00",
+	}
+	for _, tc := range testCases {
+		dir := t.TempDir()
+		store := openTestStore(t, dir, tc.Options)
+		store.Set("foo", "bar")
+		for key, value := range expected {
+			if err := store.Set(key, value); err != nil {
+				t.Fatalf("%s: %v", tc.Name, err)
+			}
+		}
+		if err := store.Close(); err != nil {
+			t.Fatalf("%s: %v", tc.Name, err)
+		}
+
+		store = openTestStore(t, dir, tc.Options)
+		expectValues(t, store, expected)
+		if _, ok := store.Get("missing"); ok {
+			t.Errorf("%s: missing key found", tc.Name)
+		}
+		store.Close()
+	}
+}
+
+func TestLogStoreDelete(t *testing.T) {
+	for _, threshold := range []int64{0, 1} {
+		dir := t.TempDir()
+		store := openTestStore(t, dir, LogStoreOptions{CompactThreshold: threshold})
+		store.Set("gone", "soon")
+		store.Set("kept", "value")
+		store.Delete("gone")
+		store.Delete("never there")
+		store.Close()
+
+		store = openTestStore(t, dir, LogStoreOptions{})
+		if value, ok := store.Get("gone"); ok {
+			t.Errorf("Threshold %d: deleted key came back with %q", threshold, value)
+		}
+		expectValues(t, store, map[string]string{"kept": "value"})
+		if store.Len() != 1 {
+			t.Errorf("Threshold %d: expected 1 key, got %d", threshold, store.Len())
+		}
+		store.Close()
+	}
+}
+
+func TestLogStoreCompaction(t *testing.T) {
+	dir := t.TempDir()
+	store := openTestStore(t, dir, LogStoreOptions{Sync: SyncNever, CompactThreshold: 1024})
+	expected := make(map[string]string)
+	for i := 0; i < 1000; i++ {
+		key := fmt.Sprintf("key%d", i%10)
+		expected[key] = strconv.Itoa(i)
+		store.Set(key, expected[key])
+	}
+	store.Close()
+
+	// 1000 writes of the same 10 keys don't pile up
+	info, err := os.Stat(filepath.Join(dir, LogFile))
+	if err != nil || info.Size() >= 1024 {
+		t.Errorf("expected the log to be compacted, got %v (%v)", info.Size(), err)
+	}
+	// Half written snapshot of a compaction that didn't finish
+	os.WriteFile(filepath.Join(dir, SnapshotFile+".tmp"), []byte("garbage"), 0644)
+
+	store = openTestStore(t, dir, LogStoreOptions{})
+	defer store.Close()
+	expectValues(t, store, expected)
+}
+
+func TestLogStoreTornWrite(t *testing.T) {
+	type test struct {
+		Name string
+		Tail []byte
+	}
+	record := encodeRecord("lost", "in the crash")
+	corrupt := encodeRecord("lost", "in the crash")
+	corrupt[len(corrupt)-1] ^= 0xff
+	testCases := []test{
+		{Name: "half a header", Tail: record[:5]},
+		{Name: "half a body", Tail: record[:len(record)-3]},
+		{Name: "bad checksum", Tail: corrupt},
+		{Name: "absurd length", Tail: []byte{0, 0, 0, 0, 0xff, 0xff, 0xff, 0xff, 0, 0, 0, 0}},
+	}
+
+	for _, tc := range testCases {
+		dir := t.TempDir()
+		store := openTestStore(t, dir, LogStoreOptions{})
+		store.Set("kept", "value")
+		store.Close()
+
+		file, _ := os.OpenFile(filepath.Join(dir, LogFile), os.O_APPEND|os.O_WRONLY, 0644)
+		file.Write(tc.Tail)
+		file.Close()
+
+		store = openTestStore(t, dir, LogStoreOptions{})
+		expectValues(t, store, map[string]string{"kept": "value"})
+		if _, ok := store.Get("lost"); ok {
+			t.Errorf("%s: torn record was loaded", tc.Name)
+		}
+		// Writes after the torn one must not get lost behind it
+		store.Set("after", "crash")
+		store.Close()
+
+		store = openTestStore(t, dir, LogStoreOptions{})
+		expectValues(t, store, map[string]string{"kept": "value", "after": "crash"})
+		store.Close()
+	}
+}
+
+func TestBrokenSnapshot(t *testing.T) {
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, SnapshotFile), encodeRecord("key", "value")[:10], 0644)
+	if _, err := OpenLogStore(dir, LogStoreOptions{}); err == nil {
+		t.Error("Damaged snapshots should be refused")
+	}
+}
+
+// The writer process TestLogStoreKilledMidWrite kills, not a test on its own
+const killedWriterDirEnv = "LOGSTORE_KILLED_WRITER_DIR"
+
+func TestLogStoreKilledWriter(t *testing.T) {
+	dir := os.Getenv(killedWriterDirEnv)
+	if dir == "" {
+		t.Skip("only runs as TestLogStoreKilledMidWrite's child")
+	}
+	store := openTestStore(t, dir, LogStoreOptions{Sync: SyncNever, CompactThreshold: 4096})
+	for i := 0; ; i++ {
+		if err := store.Set(fmt.Sprintf("key%d", i%100), strconv.Itoa(i)); err != nil {
+			t.Fatal(err)
+		}
+		// Acknowledge the write
+		fmt.Println(i)
+	}
+}
+
+func TestLogStoreKilledMidWrite(t *testing.T) {
+	if testing.Short() {
+		t.Skip("starts a second process")
+	}
+	for round := 0; round < 5; round++ {
+		dir := t.TempDir()
+		cmd := exec.Command(os.Args[0], "-test.run=^TestLogStoreKilledWriter$")
+		cmd.Env = append(os.Environ(), killedWriterDirEnv+"="+dir)
+		stdout, err := cmd.StdoutPipe()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := cmd.Start(); err != nil {
+			t.Fatal(err)
+		}
+
+		// Pull the plug somewhere in the middle, a few rounds make it likely
+		// to hit writes and compactions alike
+		acknowledged := -1
+		scanner := bufio.NewScanner(stdout)
+		for scanner.Scan() && acknowledged < 2000+round*777 {
+			if i, err := strconv.Atoi(scanner.Text()); err == nil {
+				acknowledged = i
+			}
+		}
+		cmd.Process.Kill()
+		cmd.Wait()
+		if acknowledged < 0 {
+			t.Fatal("writer never acknowledged a write")
+		}
+
+		store := openTestStore(t, dir, LogStoreOptions{})
+		// Every key holds its last acknowledged value or one the writer got
+		// to after that
+		for key := 0; key < 100 && key <= acknowledged; key++ {
+			last := acknowledged - (acknowledged-key)%100
+			value, _ := store.Get(fmt.Sprintf("key%d", key))
+			if got, err := strconv.Atoi(value); err != nil || got < last || got%100 != key {
+				t.Errorf("round %d, key%d: expected at least %d, got %q", round, key, last, value)
+			}
+		}
+		store.Close()
+	}
+}
+
+// Gets halfway through the write after the first few, then fails
+// Lets writes and syncs succeed that many times, then fails them
+type failingLog struct {
+	*os.File
+	writes int
+	syncs  int
+}
+
+func (f *failingLog) Write(p []byte) (int, error) {
+	f.writes--
+	if f.writes >= 0 {
+		return f.File.Write(p)
+	}
+	n, _ := f.File.Write(p[:len(p)/2])
+	return n, io.ErrShortWrite
+}
+
+func (f *failingLog) Sync() error {
+	f.syncs--
+	if f.syncs >= 0 {
+		return f.File.Sync()
+	}
+	return errors.New("sync failed")
+}
+
+func TestLogStoreFailedWrite(t *testing.T) {
+	type test struct {
+		Name   string
+		Writes int
+		Syncs  int
+	}
+	testCases := []test{
+		{Name: "torn write", Writes: 1, Syncs: 10},
+		// Written in full but not on disk for sure
+		{Name: "failed sync", Writes: 10, Syncs: 1},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.Name, func(t *testing.T) {
+			dir := t.TempDir()
+			store := openTestStore(t, dir, LogStoreOptions{Sync: SyncAlways})
+			store.Set("kept", "value")
+			store.log = &failingLog{File: store.log.(*os.File), writes: tc.Writes, syncs: tc.Syncs}
+
+			if err := store.Set("before", "failure"); err != nil {
+				t.Fatal(err)
+			}
+			if err := store.Set("lost", "in the failed write"); err == nil {
+				t.Fatal("expected the write to fail")
+			}
+			if _, ok := store.Get("lost"); ok {
+				t.Error("failed write shouldn't change the data")
+			}
+			// Must not end up behind the failed record
+			store.log = store.log.(*failingLog).File
+			if err := store.Set("after", "failure"); err != nil {
+				t.Fatal(err)
+			}
+			store.Close()
+
+			store = openTestStore(t, dir, LogStoreOptions{})
+			defer store.Close()
+			expectValues(t, store, map[string]string{"kept": "value", "before": "failure", "after": "failure"})
+			if _, ok := store.Get("lost"); ok {
+				t.Error("failed write came back after reopening")
+			}
+		})
+	}
+}
@@ -1,9 +1,12 @@
 package main
 
 import (
+	"flag"
 	"log"
 	"net"
-	"strings"
+	"net/http"
+	"runtime"
+	"time"
 )
 
 const (
@@ -12,52 +15,139 @@ const (
 	TYPE = "udp"
 )
 
-func handleConnection(conn net.PacketConn, addr net.Addr, line []byte, db *map[string]string) {
+const VERSION = "Light DB v1.0"
 
-	// Read until newline
-	lineBuffer := string(line)
-	if strings.Contains(lineBuffer, "=") {
+func handleConnection(conn net.PacketConn, addr net.Addr, line []byte, db *Database) {
+	if resp, ok := db.Handle(string(line)); ok {
+		conn.WriteTo([]byte(limitResponse(resp)), addr)
+	}
+}
 
-		if lineBuffer[0] == '=' {
-			(*db)[""] = string(lineBuffer[1:])
-		} else {
-			key_val := strings.SplitN(lineBuffer, "=", 2)
+// Reads packets from pc on workers goroutines and answers them until pc
+// fails, then stops all of them. oversized decides about requests that are
+// too long, verbose logs every request.
+func Serve(pc net.PacketConn, db *Database, workers int, oversized OversizePolicy, verbose bool) error {
+	errs := make(chan error, workers)
+	for i := 0; i < workers; i++ {
+		go func() {
+			// Anything that fills it up completely is too long, the
+			// kernel drops the rest
+			lineBuffer := make([]byte, MaxPacketSize)
+			for {
+				n, addr, err := pc.ReadFrom(lineBuffer)
+				if err != nil {
+					errs <- err
+					return
+				}
+				if verbose {
+					// Logging takes a lock, all workers would queue up here
+					log.Printf("RCV: %q\n", lineBuffer[:n])
+				}
 
-			// Make sure "version" may not be modified
-			if key_val[0] == "version" {
-				return
+				line, ok := checkRequestSize(lineBuffer[:n], oversized)
+				if !ok {
+					log.Printf("Ignoring request of %d bytes or more from %s", n, addr)
+					continue
+				}
+				handleConnection(pc, addr, line, db)
 			}
+		}()
+	}
+	err := <-errs
+	pc.Close()
+	return err
+}
 
-			(*db)[key_val[0]] = key_val[1]
+func main() {
+	var storeOptions StoreOptions
+	flag.StringVar(&storeOptions.Kind, "store", "memory", "where to keep the data: memory or log")
+	flag.StringVar(&storeOptions.Dir, "data-dir", "data", "directory for the log store's files")
+	flag.StringVar(&storeOptions.Sync, "fsync", "always", "when the log store flushes writes to disk: always, interval or never")
+	flag.DurationVar(&storeOptions.SyncInterval, "fsync-interval", time.Second, "how often to flush with -fsync interval")
+	flag.Int64Var(&storeOptions.CompactThreshold, "compact-threshold", 64<<20, "fold the log into a snapshot once it grows beyond this many bytes, 0 never does")
+	oversized := flag.String("oversized", "reject", "what to do with requests of 1000 bytes or more: reject or truncate")
+	reservedPrefix := flag.String("reserved-prefix", DefaultReservedPrefix, "keys starting with this are read-only and belong to the server, e.g. _stats.requests with _, empty leaves every key to the clients")
+	admin := flag.Bool("admin", false, "allow listing keys, <reserved prefix>keys.<prefix> answers with every key starting with prefix (needs -reserved-prefix)")
+	tcpAddr := flag.String("tcp-addr", "", "also serve the protocol over TCP on this address, one request per line")
+	httpAddr := flag.String("http-addr", "", "also serve a REST API on /keys/{key} on this address")
+	ttl := flag.Bool("ttl", false, "allow key@<duration>=value inserts, e.g. session@30s=abc goes away after 30 seconds, and the read-only key expired counts the keys that did (memory store only)")
+	expiryInterval := flag.Duration("expiry-interval", time.Second, "how often expired keys get cleaned up with -ttl")
+	replicationAddr := flag.String("replication-addr", "", "act as primary and let replicas connect on this address")
+	replicaOf := flag.String("replica-of", "", "act as a read-only replica of the primary with this replication address")
+	replicaRetry := flag.Duration("replica-retry", time.Second, "how long a replica waits before reconnecting to its primary")
+	workers := flag.Int("workers", runtime.NumCPU(), "how many packets are handled at the same time")
+	verbose := flag.Bool("verbose", false, "log every request, slows the server down")
+	flag.Parse()
 
+	oversizePolicy, err := ParseOversizePolicy(*oversized)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if *admin && *reservedPrefix == "" {
+		// There'd be no keys.<prefix> to ask for
+		log.Fatal("-admin needs a -reserved-prefix")
+	}
+	if *ttl && storeOptions.Kind == "log" {
+		// Deadlines only live in memory, keys would outlive a restart forever
+		log.Fatal("-ttl doesn't work with -store log")
+	}
+	store, err := OpenStore(storeOptions)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer store.Close()
+
+	switch {
+	case *replicationAddr != "" && *replicaOf != "":
+		log.Fatal("Can't be primary and replica at the same time")
+	case *replicationAddr != "":
+		primary := NewPrimary(store)
+		store = primary
+		listen, err := net.Listen("tcp", *replicationAddr)
+		if err != nil {
+			log.Fatal(err)
 		}
-	} else {
-		// GET
-		resp := lineBuffer + "="
-		resp += (*db)[string(lineBuffer)]
+		log.Printf("Serving replicas on %s", listen.Addr())
+		go func() {
+			log.Fatal(primary.ServeReplicas(listen))
+		}()
+	case *replicaOf != "":
+		go Replicate(*replicaOf, store, *replicaRetry)
+		store = readOnlyStore{store}
+	}
+	database := NewDatabase(store, *reservedPrefix, *admin)
+	if *ttl {
+		database.EnableTTL()
+		go database.ExpireEvery(*expiryInterval)
+	}
 
-		conn.WriteTo([]byte(resp), addr)
+	if *tcpAddr != "" {
+		listen, err := net.Listen("tcp", *tcpAddr)
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("Serving TCP on %s", listen.Addr())
+		go func() {
+			log.Fatal(ServeTCP(listen, database))
+		}()
+	}
+	if *httpAddr != "" {
+		listen, err := net.Listen("tcp", *httpAddr)
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("Serving HTTP on %s", listen.Addr())
+		go func() {
+			log.Fatal(http.Serve(listen, NewHTTPHandler(database)))
+		}()
 	}
-}
 
-func main() {
 	log.Printf("Starting server: %s:%s\n", HOST, PORT)
 	pc, err := net.ListenPacket(TYPE, HOST+":"+PORT)
 	if err != nil {
 		log.Fatalf(err.Error())
 	}
 	defer pc.Close()
-	database := make(map[string]string)
-	database["version"] = "Light DB v1.0"
-
-	for {
-		lineBuffer := make([]byte, 1000)
-		n, addr, err := pc.ReadFrom(lineBuffer)
-		if err != nil {
-			log.Fatal("Error while reading into line buffer")
-		}
-		log.Printf("RCV: %s\n", lineBuffer)
 
-		handleConnection(pc, addr, lineBuffer[:n], &database)
-	}
+	log.Fatal("Error while reading into line buffer: ", Serve(pc, database, *workers, oversizePolicy, *verbose))
 }
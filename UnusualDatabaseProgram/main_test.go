@@ -0,0 +1,198 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestMain(m *testing.M) {
+	// Only the test results are interesting
+	log.SetOutput(io.Discard)
+	os.Exit(m.Run())
+}
+
+// Reserves "_" so the stats keys can be checked
+func newTestDatabase(admin bool) *Database {
+	return NewDatabase(NewShardedStore(DefaultShards), "_", admin)
+}
+
+// Serves db on a random local port and returns its address
+func startServer(t testing.TB, db *Database, workers int, oversized OversizePolicy) string {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { pc.Close() })
+	go Serve(pc, db, workers, oversized, false)
+	return pc.LocalAddr().String()
+}
+
+// Sends request and waits for the answer, UDP may lose either of them so
+// it gets a few tries. Safe to call from any goroutine.
+func query(t testing.TB, conn net.Conn, request string) string {
+	response := make([]byte, 1000)
+	for try := 0; try < 5; try++ {
+		conn.Write([]byte(request))
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		n, err := conn.Read(response)
+		if err == nil {
+			return string(response[:n])
+		}
+	}
+	t.Errorf("no answer to %q", request)
+	return ""
+}
+
+func dialServer(t testing.TB, addr string) net.Conn {
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+func TestServeConcurrently(t *testing.T) {
+	addr := startServer(t, newTestDatabase(false), 4, RejectOversized)
+
+	var wg sync.WaitGroup
+	for client := 0; client < 8; client++ {
+		conn := dialServer(t, addr)
+		wg.Add(1)
+		go func(client int) {
+			defer wg.Done()
+			for i := 0; i < 50; i++ {
+				key := fmt.Sprintf("client%d-%d", client, i)
+				conn.Write([]byte(key + "=" + key))
+				// Requests from one client may be handled out of order, so
+				// wait for the value to show up
+				expected := key + "=" + key
+				for try := 0; query(t, conn, key) != expected; try++ {
+					if try == 100 {
+						t.Errorf("%s was never stored", key)
+						return
+					}
+				}
+			}
+		}(client)
+	}
+	wg.Wait()
+
+	if response := query(t, dialServer(t, addr), "version"); response != "version="+VERSION {
+		t.Errorf("expected: %q, got: %q", "version="+VERSION, response)
+	}
+}
+
+func TestRequests(t *testing.T) {
+	type test struct {
+		Name      string
+		Oversized OversizePolicy
+		// Sent first, nothing comes back for inserts
+		Inserts  []string
+		Query    string
+		Expected string
+	}
+
+	long := strings.Repeat("x", MaxPacketSize)
+	testCases := []test{
+		{Name: "insert", Inserts: []string{"foo=bar"}, Query: "foo", Expected: "foo=bar"},
+		{Name: "overwrite", Inserts: []string{"foo=bar", "foo=baz"}, Query: "foo", Expected: "foo=baz"},
+		{Name: "more equals", Inserts: []string{"foo=bar=baz"}, Query: "foo", Expected: "foo=bar=baz"},
+		{Name: "only equals", Inserts: []string{"foo==="}, Query: "foo", Expected: "foo==="},
+		{Name: "empty value", Inserts: []string{"foo=bar", "foo="}, Query: "foo", Expected: "foo="},
+		{Name: "empty key", Inserts: []string{"=foo"}, Query: "", Expected: "=foo"},
+		{Name: "empty key and value", Inserts: []string{"="}, Query: "", Expected: "="},
+		{Name: "missing", Query: "missing", Expected: "missing="},
+		{Name: "version", Query: "version", Expected: "version=" + VERSION},
+		{Name: "read-only version", Inserts: []string{"version=hacked"}, Query: "version", Expected: "version=" + VERSION},
+		{Name: "spaces and newlines", Inserts: []string{" key \n= value\n"}, Query: " key \n", Expected: " key \n= value\n"},
+		// 999 bytes is the most there may be
+		{Name: "largest", Inserts: []string{"big=" + long[:995]}, Query: "big", Expected: "big=" + long[:995]},
+		{Name: "rejected", Inserts: []string{"big=" + long[:996]}, Query: "big", Expected: "big="},
+		{Name: "truncated", Oversized: TruncateOversized, Inserts: []string{"big=" + long}, Query: "big", Expected: "big=" + long[:995]},
+		// Where the equals sign doesn't fit it's a retrieve and ignored
+		{Name: "truncated retrieve", Oversized: TruncateOversized, Inserts: []string{long + "=value"}, Query: long[:10], Expected: long[:10] + "="},
+	}
+
+	for _, tc := range testCases {
+		// A single worker handles everything in order
+		conn := dialServer(t, startServer(t, newTestDatabase(false), 1, tc.Oversized))
+		for _, insert := range tc.Inserts {
+			conn.Write([]byte(insert))
+		}
+		if response := query(t, conn, tc.Query); response != tc.Expected {
+			t.Errorf("%s: expected: %q, got: %q", tc.Name, tc.Expected, response)
+		}
+	}
+}
+
+func TestOversizedRetrieveIgnored(t *testing.T) {
+	conn := dialServer(t, startServer(t, newTestDatabase(false), 1, TruncateOversized))
+	conn.Write([]byte(strings.Repeat("x", MaxPacketSize)))
+	conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	if n, err := conn.Read(make([]byte, MaxPacketSize)); err == nil {
+		t.Errorf("expected no answer, got %d bytes", n)
+	}
+}
+
+func TestLimitResponse(t *testing.T) {
+	long := strings.Repeat("x", 2*MaxPacketSize)
+	for _, response := range []string{"", "key=value", long[:MaxPacketSize-1], long[:MaxPacketSize], long} {
+		limited := limitResponse(response)
+		if len(limited) >= MaxPacketSize || !strings.HasPrefix(response, limited) {
+			t.Errorf("Response of %d bytes limited to %d bytes", len(response), len(limited))
+		}
+	}
+}
+
+// Run with -cpu 1,2,4,8, more workers should answer more queries as long as
+// there are cores for them and clients keeping them busy
+func BenchmarkServe(b *testing.B) {
+	for _, workers := range []int{1, 8} {
+		b.Run(fmt.Sprintf("%d workers", workers), func(b *testing.B) {
+			db := newTestDatabase(false)
+			db.Set("key", "value")
+			addr := startServer(b, db, workers, RejectOversized)
+			b.RunParallel(func(pb *testing.PB) {
+				conn := dialServer(b, addr)
+				for pb.Next() {
+					query(b, conn, "key")
+				}
+			})
+		})
+	}
+}
+
+// Requests only show up in the log with -verbose
+func TestVerboseLogging(t *testing.T) {
+	defer log.SetOutput(io.Discard)
+	for _, verbose := range []bool{false, true} {
+		var logged strings.Builder
+		log.SetOutput(&logged)
+
+		pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		served := make(chan struct{})
+		go func() {
+			Serve(pc, newTestDatabase(false), 1, RejectOversized, verbose)
+			close(served)
+		}()
+		conn := dialServer(t, pc.LocalAddr().String())
+		query(t, conn, "version")
+		pc.Close()
+		<-served
+
+		if got := strings.Contains(logged.String(), `RCV: "version"`); got != verbose {
+			t.Errorf("verbose %v: request logged: %v", verbose, got)
+		}
+	}
+}
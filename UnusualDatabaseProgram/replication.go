@@ -0,0 +1,222 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	// Changes a replica may fall behind before it gets dropped, it then
+	// catches up from a snapshot when it reconnects
+	ReplicaBacklog = 4096
+	// How often the primary speaks up when nothing changes. Replicas give
+	// up on a primary after three missed heartbeats.
+	ReplicaHeartbeat = time.Second
+)
+
+// Sends every change to its store on to the replicas. Writes take turns, so
+// replicas see them in the order they happened.
+type Primary struct {
+	Store
+	mu       sync.Mutex
+	replicas map[chan []byte]bool
+}
+
+func NewPrimary(store Store) *Primary {
+	return &Primary{Store: store, replicas: make(map[chan []byte]bool)}
+}
+
+func (p *Primary) Set(key string, value string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if err := p.Store.Set(key, value); err != nil {
+		return err
+	}
+	p.publish(encodeRecord(key, value))
+	return nil
+}
+
+func (p *Primary) Delete(key string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if err := p.Store.Delete(key); err != nil {
+		return err
+	}
+	p.publish(encodeDelete(key))
+	return nil
+}
+
+// Must hold p.mu
+func (p *Primary) publish(record []byte) {
+	for updates := range p.replicas {
+		select {
+		case updates <- record:
+		default:
+			// Too slow, it has to start over
+			delete(p.replicas, updates)
+			close(updates)
+		}
+	}
+}
+
+// Disconnects all replicas and closes the store
+func (p *Primary) Close() error {
+	p.mu.Lock()
+	for updates := range p.replicas {
+		delete(p.replicas, updates)
+		close(updates)
+	}
+	p.mu.Unlock()
+	return p.Store.Close()
+}
+
+// Accepts replicas until the listener fails
+func (p *Primary) ServeReplicas(listen net.Listener) error {
+	for {
+		conn, err := listen.Accept()
+		if err != nil {
+			return err
+		}
+		log.Printf("Replica connected from %s", conn.RemoteAddr())
+		go p.serveReplica(conn)
+	}
+}
+
+// Sends a snapshot of everything, then every change as it happens
+func (p *Primary) serveReplica(conn net.Conn) {
+	defer conn.Close()
+	writer := bufio.NewWriter(conn)
+
+	updates := make(chan []byte, ReplicaBacklog)
+	var snapshot [][]byte
+	p.mu.Lock()
+	// Nothing can change while the snapshot is taken, so the updates pick
+	// up exactly where it ends
+	for _, key := range p.Store.Keys("") {
+		if value, ok := p.Store.Get(key); ok {
+			snapshot = append(snapshot, encodeRecord(key, value))
+		}
+	}
+	p.replicas[updates] = true
+	p.mu.Unlock()
+	defer func() {
+		p.mu.Lock()
+		if p.replicas[updates] {
+			delete(p.replicas, updates)
+			close(updates)
+		}
+		p.mu.Unlock()
+	}()
+
+	for _, record := range snapshot {
+		writer.Write(record)
+	}
+	writer.Write(encodeMarker("", snapshotEndValue))
+	heartbeat := time.NewTicker(ReplicaHeartbeat)
+	defer heartbeat.Stop()
+	for {
+		if err := writer.Flush(); err != nil {
+			log.Printf("Lost replica %s: %v", conn.RemoteAddr(), err)
+			return
+		}
+		select {
+		case record, ok := <-updates:
+			if !ok {
+				log.Printf("Dropping replica %s", conn.RemoteAddr())
+				return
+			}
+			writer.Write(record)
+			// Send whatever else is waiting in one go
+			for len(updates) > 0 {
+				if record, ok := <-updates; ok {
+					writer.Write(record)
+				}
+			}
+		case <-heartbeat.C:
+			writer.Write(encodeMarker("", heartbeatValue))
+		}
+	}
+}
+
+// What clients of a replica get to see, only replication changes it
+type readOnlyStore struct {
+	Store
+}
+
+func (readOnlyStore) Set(key string, value string) error {
+	return ErrReadOnly
+}
+
+func (readOnlyStore) Delete(key string) error {
+	return ErrReadOnly
+}
+
+// Keeps store a copy of the primary's at addr, forever. Whenever the
+// connection drops it tries again after retryDelay and catches up from a
+// fresh snapshot.
+func Replicate(addr string, store Store, retryDelay time.Duration) {
+	for {
+		err := replicateOnce(addr, store)
+		log.Printf("Lost primary %s: %v", addr, err)
+		time.Sleep(retryDelay)
+	}
+}
+
+func replicateOnce(addr string, store Store) error {
+	conn, err := net.DialTimeout("tcp", addr, 3*ReplicaHeartbeat)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+
+	// Only replaces what the store has once all of it arrived, so reads
+	// keep getting the old values in the meantime
+	snapshot := make(map[string]string)
+	for {
+		conn.SetReadDeadline(time.Now().Add(3 * ReplicaHeartbeat))
+		record, err := readRecord(reader)
+		if err != nil {
+			return err
+		}
+
+		switch {
+		case record.marker == heartbeatValue:
+		case record.marker == snapshotEndValue:
+			if snapshot == nil {
+				return errors.New("second snapshot in one stream")
+			}
+			applySnapshot(store, snapshot)
+			log.Printf("Caught up with primary %s, %d keys", addr, len(snapshot))
+			snapshot = nil
+		case snapshot != nil && record.marker == deletedValue:
+			delete(snapshot, record.key)
+		case snapshot != nil:
+			snapshot[record.key] = record.value
+		case record.marker == deletedValue:
+			err = store.Delete(record.key)
+		default:
+			err = store.Set(record.key, record.value)
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func applySnapshot(store Store, snapshot map[string]string) {
+	for _, key := range store.Keys("") {
+		if _, ok := snapshot[key]; !ok {
+			store.Delete(key)
+		}
+	}
+	for key, value := range snapshot {
+		if current, ok := store.Get(key); !ok || current != value {
+			store.Set(key, value)
+		}
+	}
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+// Waits for condition to come true
+func eventually(t *testing.T, what string, condition func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatalf("gave up waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func startPrimary(t *testing.T, store Store, addr string) (*Primary, net.Listener) {
+	primary := NewPrimary(store)
+	listen, err := net.Listen("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		listen.Close()
+		primary.Close()
+	})
+	go primary.ServeReplicas(listen)
+	return primary, listen
+}
+
+func hasValue(store Store, key string, expected string) func() bool {
+	return func() bool {
+		value, ok := store.Get(key)
+		return ok && value == expected
+	}
+}
+
+func hasNoKey(store Store, key string) func() bool {
+	return func() bool {
+		_, ok := store.Get(key)
+		return !ok
+	}
+}
+
+func TestReplication(t *testing.T) {
+	data := NewShardedStore(DefaultShards)
+	data.Set("before", "1")
+	data.Set("doomed", "x")
+	primary, listen := startPrimary(t, data, "127.0.0.1:0")
+	addr := listen.Addr().String()
+	primaryDB := NewDatabase(primary, DefaultReservedPrefix, false)
+	primaryUDP := dialServer(t, startServer(t, primaryDB, 1, RejectOversized))
+
+	// Two replicas, each serving reads over UDP
+	var replicas []Store
+	var replicaUDP []net.Conn
+	for i := 0; i < 2; i++ {
+		store := NewShardedStore(DefaultShards)
+		go Replicate(addr, store, 10*time.Millisecond)
+		replicas = append(replicas, store)
+		replicaDB := NewDatabase(readOnlyStore{store}, DefaultReservedPrefix, false)
+		replicaUDP = append(replicaUDP, dialServer(t, startServer(t, replicaDB, 1, RejectOversized)))
+	}
+
+	for i, replica := range replicas {
+		eventually(t, "the snapshot", hasValue(replica, "before", "1"))
+		if response := query(t, replicaUDP[i], "doomed"); response != "doomed=x" {
+			t.Errorf("Replica %d: expected: %q, got: %q", i, "doomed=x", response)
+		}
+	}
+
+	// Live changes
+	primaryUDP.Write([]byte("live=2"))
+	primaryDB.Delete("doomed")
+	for i, replica := range replicas {
+		eventually(t, "an insert", hasValue(replica, "live", "2"))
+		eventually(t, "a delete", hasNoKey(replica, "doomed"))
+		if response := query(t, replicaUDP[i], "live"); response != "live=2" {
+			t.Errorf("Replica %d: expected: %q, got: %q", i, "live=2", response)
+		}
+	}
+
+	// Replicas only read
+	replicaUDP[0].Write([]byte("sneaky=1"))
+	if response := query(t, replicaUDP[0], "sneaky"); response != "sneaky=" {
+		t.Errorf("Replica took a write: %q", response)
+	}
+	if _, ok := data.Get("sneaky"); ok {
+		t.Error("Write to a replica reached the primary")
+	}
+
+	// The primary goes away and misses changes while it's gone, replicas
+	// catch up once it's back
+	listen.Close()
+	primary.Close()
+	data.Set("missed", "3")
+	data.Delete("before")
+	startPrimary(t, data, addr)
+	for _, replica := range replicas {
+		eventually(t, "catching up", hasValue(replica, "missed", "3"))
+		eventually(t, "catching up on deletes", hasNoKey(replica, "before"))
+		if value, _ := replica.Get("live"); value != "2" {
+			t.Errorf("Lost %q across the reconnect, got %q", "live", value)
+		}
+	}
+}
+
+func TestSlowReplicaDropped(t *testing.T) {
+	primary := NewPrimary(NewShardedStore(1))
+	updates := make(chan []byte, 1)
+	primary.replicas[updates] = true
+
+	primary.Set("a", "1")
+	primary.Set("b", "2")
+	if primary.replicas[updates] {
+		t.Error("Replica should be dropped once its backlog is full")
+	}
+	if record := <-updates; string(record) != string(encodeRecord("a", "1")) {
+		t.Errorf("expected the first update, got %q", record)
+	}
+	if _, ok := <-updates; ok {
+		t.Error("expected the updates to be closed")
+	}
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+const DefaultShards = 64
+
+// Where the key value pairs live
+type Store interface {
+	Get(key string) (string, bool)
+	Set(key string, value string) error
+	Delete(key string) error
+	// How many keys there are
+	Len() int
+	// All keys starting with prefix, in no particular order
+	Keys(prefix string) []string
+	Close() error
+}
+
+// Keeps everything in memory, gone on restart. Keys are spread over
+// shards with a lock each, so workers rarely wait for each other.
+type ShardedStore struct {
+	shards []mapShard
+}
+
+type mapShard struct {
+	mu   sync.RWMutex
+	data map[string]string
+}
+
+func NewShardedStore(shards int) *ShardedStore {
+	if shards < 1 {
+		shards = 1
+	}
+	s := &ShardedStore{shards: make([]mapShard, shards)}
+	for i := range s.shards {
+		s.shards[i].data = make(map[string]string)
+	}
+	return s
+}
+
+// FNV-1a, inlined so looking up a key doesn't allocate
+func (s *ShardedStore) shard(key string) *mapShard {
+	hash := uint32(2166136261)
+	for i := 0; i < len(key); i++ {
+		hash ^= uint32(key[i])
+		hash *= 16777619
+	}
+	return &s.shards[hash%uint32(len(s.shards))]
+}
+
+func (s *ShardedStore) Get(key string) (string, bool) {
+	shard := s.shard(key)
+	shard.mu.RLock()
+	defer shard.mu.RUnlock()
+	value, ok := shard.data[key]
+	return value, ok
+}
+
+func (s *ShardedStore) Set(key string, value string) error {
+	shard := s.shard(key)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+	shard.data[key] = value
+	return nil
+}
+
+func (s *ShardedStore) Delete(key string) error {
+	shard := s.shard(key)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+	delete(shard.data, key)
+	return nil
+}
+
+func (s *ShardedStore) Len() int {
+	length := 0
+	for i := range s.shards {
+		s.shards[i].mu.RLock()
+		length += len(s.shards[i].data)
+		s.shards[i].mu.RUnlock()
+	}
+	return length
+}
+
+func (s *ShardedStore) Keys(prefix string) []string {
+	var keys []string
+	for i := range s.shards {
+		s.shards[i].mu.RLock()
+		keys = appendKeys(keys, s.shards[i].data, prefix)
+		s.shards[i].mu.RUnlock()
+	}
+	return keys
+}
+
+func appendKeys(keys []string, data map[string]string, prefix string) []string {
+	for key := range data {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+func (s *ShardedStore) Close() error {
+	return nil
+}
+
+// How the store is picked on the command line
+type StoreOptions struct {
+	// memory or log
+	Kind             string
+	Dir              string
+	Sync             string
+	SyncInterval     time.Duration
+	CompactThreshold int64
+}
+
+func OpenStore(options StoreOptions) (Store, error) {
+	switch options.Kind {
+	case "memory":
+		return NewShardedStore(DefaultShards), nil
+	case "log":
+		policy, err := ParseSyncPolicy(options.Sync)
+		if err != nil {
+			return nil, err
+		}
+		return OpenLogStore(options.Dir, LogStoreOptions{
+			Sync:             policy,
+			SyncInterval:     options.SyncInterval,
+			CompactThreshold: options.CompactThreshold,
+		})
+	}
+	return nil, fmt.Errorf("unknown store %q (want memory or log)", options.Kind)
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+func TestShardedStore(t *testing.T) {
+	for _, shards := range []int{0, 1, DefaultShards} {
+		store := NewShardedStore(shards)
+		var wg sync.WaitGroup
+		for worker := 0; worker < 8; worker++ {
+			wg.Add(1)
+			go func(worker int) {
+				defer wg.Done()
+				for i := 0; i < 1000; i++ {
+					store.Set(fmt.Sprintf("%d-%d", worker, i), strconv.Itoa(i))
+					store.Get(fmt.Sprintf("%d-%d", worker, i/2))
+				}
+			}(worker)
+		}
+		wg.Wait()
+
+		for worker := 0; worker < 8; worker++ {
+			for i := 0; i < 1000; i++ {
+				if value, ok := store.Get(fmt.Sprintf("%d-%d", worker, i)); !ok || value != strconv.Itoa(i) {
+					t.Fatalf("%d shards, key %d-%d: expected: %d, got: %q (%v)", shards, worker, i, i, value, ok)
+				}
+			}
+		}
+	}
+}
+
+// Run with -cpu 1,2,4,8 to see how the shards scale compared to a single
+// lock around all keys
+func BenchmarkStores(b *testing.B) {
+	type benchmark struct {
+		Name  string
+		Store Store
+	}
+	benchmarks := []benchmark{
+		{Name: "one shard", Store: NewShardedStore(1)},
+		{Name: "sharded", Store: NewShardedStore(DefaultShards)},
+	}
+	keys := make([]string, 1024)
+	for i := range keys {
+		keys[i] = "key" + strconv.Itoa(i)
+	}
+
+	for _, bm := range benchmarks {
+		b.Run(bm.Name, func(b *testing.B) {
+			b.RunParallel(func(pb *testing.PB) {
+				for i := 0; pb.Next(); i++ {
+					key := keys[i%len(keys)]
+					// One write for every three reads
+					if i%4 == 0 {
+						bm.Store.Set(key, "value")
+					} else {
+						bm.Store.Get(key)
+					}
+				}
+			})
+		})
+	}
+}